@@ -0,0 +1,134 @@
+// Copyright 2023 Authors of kmerge
+// SPDX-License-Identifier: Apache-2.0
+
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/yylt/kmerge/pkg/resource"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+	"k8s.io/klog/v2"
+	ctrl "sigs.k8s.io/controller-runtime"
+)
+
+const redacted = "<redacted>"
+
+var (
+	explainKubeconfig string
+	explainShowValues bool
+	explainOutput     string
+)
+
+// explainCmd shows which source supplied every key of a primary.
+var explainCmd = &cobra.Command{
+	Use:   "explain <namespace>/<name>",
+	Short: "show which source secret supplied every key of a primary",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		parts := strings.Split(args[0], "/")
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			klog.Exitf("invalid primary %q, want <namespace>/<name>", args[0])
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		defer cancel()
+		ex, err := explainPrimary(ctx, parts[0], parts[1])
+		if err != nil {
+			klog.Exitf("Failed to explain %s: %v", args[0], err)
+		}
+		if !explainShowValues {
+			for i := range ex.Keys {
+				ex.Keys[i].Value = redacted
+			}
+		}
+		if err = printExplain(cmd.OutOrStdout(), ex, explainOutput); err != nil {
+			klog.Exitf("Failed to print: %v", err)
+		}
+	},
+}
+
+func explainPrimary(ctx context.Context, namespace, name string) (*resource.Explanation, error) {
+	var (
+		config *rest.Config
+		err    error
+	)
+	if explainKubeconfig != "" {
+		config, err = clientcmd.BuildConfigFromFlags("", explainKubeconfig)
+	} else {
+		config, err = ctrl.GetConfig()
+	}
+	if err != nil {
+		return nil, err
+	}
+	clientSet, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return nil, err
+	}
+
+	primary, err := clientSet.CoreV1().Secrets(namespace).Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+	var (
+		secrets    []corev1.Secret
+		namespaces = resource.SourceNamespaces(primary.Annotations)
+	)
+	if len(namespaces) == 0 {
+		namespaces = []string{metav1.NamespaceAll}
+	}
+	for _, ns := range namespaces {
+		list, err := clientSet.CoreV1().Secrets(ns).List(ctx, metav1.ListOptions{})
+		if err != nil {
+			return nil, err
+		}
+		secrets = append(secrets, list.Items...)
+	}
+	return resource.Explain(primary, secrets)
+}
+
+func printExplain(w io.Writer, ex *resource.Explanation, output string) error {
+	switch output {
+	case "json":
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(ex)
+	case "", "table":
+	default:
+		return fmt.Errorf("unknown output %q", output)
+	}
+
+	fmt.Fprintf(w, "primary %s (%s), sources: %s\n\n", ex.Primary, ex.Kind, strings.Join(ex.Sources, ", "))
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "KEY\tPATH\tSOURCES\tOVERRIDDEN\tVALUE")
+	for _, v := range ex.Keys {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", v.Key, orNone(v.Path), orNone(strings.Join(v.Sources, ",")),
+			orNone(strings.Join(v.Overridden, ",")), v.Value)
+	}
+	return tw.Flush()
+}
+
+func orNone(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+func init() {
+	explainCmd.Flags().StringVar(&explainKubeconfig, "kubeconfig", "", "path to the kubeconfig file, default is in-cluster or $KUBECONFIG")
+	explainCmd.Flags().BoolVar(&explainShowValues, "show-values", false, "show merged values instead of redacting them")
+	explainCmd.Flags().StringVarP(&explainOutput, "output", "o", "table", "output format, table or json")
+	rootCmd.AddCommand(explainCmd)
+}
@@ -0,0 +1,290 @@
+// Copyright 2023 Authors of kmerge
+// SPDX-License-Identifier: Apache-2.0
+
+package cmd
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"github.com/yylt/kmerge/pkg/resource"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	utilyaml "k8s.io/apimachinery/pkg/util/yaml"
+	"k8s.io/klog/v2"
+	"sigs.k8s.io/yaml"
+)
+
+var (
+	mergeFiles []string
+	mergeDiff  bool
+)
+
+// mergeCmd renders merges from local manifests.
+var mergeCmd = &cobra.Command{
+	Use:     "merge",
+	Aliases: []string{"preview"},
+	Short:   "render merged primaries from local Secret/ConfigMap manifests",
+	Args:    cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		manifests, err := readManifests(mergeFiles)
+		if err != nil {
+			klog.Exitf("Failed to read manifests: %v", err)
+		}
+
+		var results []mergeResult
+		for _, v := range resource.PreviewSecrets(manifests.secrets) {
+			results = append(results, mergeResult{Preview: v, kind: "Secret"})
+		}
+		for _, v := range resource.PreviewSecrets(manifests.configMaps) {
+			results = append(results, mergeResult{Preview: v, kind: "ConfigMap"})
+		}
+
+		failed := printMerge(cmd.OutOrStdout(), results, mergeDiff)
+		if failed > 0 {
+			klog.Exitf("%d primaries failed to merge", failed)
+		}
+	},
+}
+
+type mergeResult struct {
+	resource.Preview
+	kind string
+}
+
+type manifests struct {
+	secrets []corev1.Secret
+
+	// configmaps are merged in the same way, data is kept as secret data
+	configMaps []corev1.Secret
+}
+
+// readManifests reads Secrets and ConfigMaps from yaml or json files, the
+// directories are walked recursively.
+func readManifests(paths []string) (*manifests, error) {
+	m := &manifests{}
+	for _, p := range paths {
+		err := filepath.WalkDir(p, func(path string, d os.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if d.IsDir() {
+				return nil
+			}
+			switch filepath.Ext(path) {
+			case ".yaml", ".yml", ".json":
+			default:
+				if path != p {
+					return nil
+				}
+			}
+			f, err := os.Open(path)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			if err = m.decode(f); err != nil {
+				return fmt.Errorf("%s: %v", path, err)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+func (m *manifests) decode(r io.Reader) error {
+	decoder := utilyaml.NewYAMLOrJSONDecoder(r, 4096)
+	for {
+		obj := &unstructured.Unstructured{}
+		err := decoder.Decode(&obj.Object)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if len(obj.Object) == 0 {
+			continue
+		}
+		if obj.IsList() {
+			err = obj.EachListItem(func(item runtime.Object) error {
+				return m.add(item.(*unstructured.Unstructured))
+			})
+		} else {
+			err = m.add(obj)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (m *manifests) add(obj *unstructured.Unstructured) error {
+	if obj.GetAPIVersion() != "v1" {
+		return nil
+	}
+	switch obj.GetKind() {
+	case "Secret":
+		se := corev1.Secret{}
+		if err := runtime.DefaultUnstructuredConverter.FromUnstructured(obj.Object, &se); err != nil {
+			return err
+		}
+		// same as the apiserver does
+		for k, v := range se.StringData {
+			if se.Data == nil {
+				se.Data = map[string][]byte{}
+			}
+			se.Data[k] = []byte(v)
+		}
+		se.StringData = nil
+		m.secrets = append(m.secrets, se)
+	case "ConfigMap":
+		cm := corev1.ConfigMap{}
+		if err := runtime.DefaultUnstructuredConverter.FromUnstructured(obj.Object, &cm); err != nil {
+			return err
+		}
+		se := corev1.Secret{
+			ObjectMeta: cm.ObjectMeta,
+			Data:       map[string][]byte{},
+		}
+		for k, v := range cm.Data {
+			se.Data[k] = []byte(v)
+		}
+		for k, v := range cm.BinaryData {
+			se.Data[k] = v
+		}
+		m.configMaps = append(m.configMaps, se)
+	}
+	return nil
+}
+
+// toObject returns the merged primary as its original kind.
+func (r *mergeResult) toObject() runtime.Object {
+	if r.kind == "Secret" {
+		out := r.Merged.DeepCopy()
+		out.APIVersion, out.Kind = "v1", "Secret"
+		return out
+	}
+	out := &corev1.ConfigMap{
+		ObjectMeta: *r.Merged.ObjectMeta.DeepCopy(),
+		Data:       map[string]string{},
+	}
+	out.APIVersion, out.Kind = "v1", "ConfigMap"
+	for k, v := range r.Merged.Data {
+		out.Data[k] = string(v)
+	}
+	return out
+}
+
+// printMerge prints the merged primaries as yaml, or the diff against their
+// current content. It returns the number of failed primaries.
+func printMerge(w io.Writer, results []mergeResult, diff bool) int {
+	failed := 0
+	for i := range results {
+		r := &results[i]
+		name := fmt.Sprintf("%s %s/%s", r.kind, r.Primary.Namespace, r.Primary.Name)
+		if r.Err != nil {
+			failed++
+			fmt.Fprintf(w, "# %s: merge failed: %v\n", name, r.Err)
+			continue
+		}
+		if !diff {
+			out, err := yaml.Marshal(r.toObject())
+			if err != nil {
+				failed++
+				fmt.Fprintf(w, "# %s: %v\n", name, err)
+				continue
+			}
+			fmt.Fprintf(w, "---\n# sources: %s\n%s", strings.Join(r.Sources, ", "), out)
+			continue
+		}
+
+		var (
+			buf  bytes.Buffer
+			keys []string
+		)
+		for k := range r.Merged.Data {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			before, after := string(r.Primary.Data[k]), string(r.Merged.Data[k])
+			if before == after {
+				continue
+			}
+			fmt.Fprintf(&buf, "@@ %s @@\n", k)
+			for _, line := range lineDiff(before, after) {
+				fmt.Fprintln(&buf, line)
+			}
+		}
+		if buf.Len() == 0 {
+			fmt.Fprintf(w, "%s: unchanged\n", name)
+			continue
+		}
+		fmt.Fprintf(w, "--- %s (current)\n+++ %s (merged)\n# sources: %s\n%s", name, name, strings.Join(r.Sources, ", "), buf.Bytes())
+	}
+	return failed
+}
+
+// lineDiff returns the lines of a and b prefixed by " ", "-" or "+", based on
+// the longest common subsequence.
+func lineDiff(a, b string) []string {
+	var (
+		x = strings.Split(a, "\n")
+		y = strings.Split(b, "\n")
+
+		lcs = make([][]int, len(x)+1)
+		out []string
+	)
+	for i := range lcs {
+		lcs[i] = make([]int, len(y)+1)
+	}
+	for i := len(x) - 1; i >= 0; i-- {
+		for j := len(y) - 1; j >= 0; j-- {
+			if x[i] == y[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else {
+				lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+			}
+		}
+	}
+	i, j := 0, 0
+	for i < len(x) && j < len(y) {
+		switch {
+		case x[i] == y[j]:
+			out = append(out, " "+x[i])
+			i++
+			j++
+		case lcs[i+1][j] >= lcs[i][j+1]:
+			out = append(out, "-"+x[i])
+			i++
+		default:
+			out = append(out, "+"+y[j])
+			j++
+		}
+	}
+	for ; i < len(x); i++ {
+		out = append(out, "-"+x[i])
+	}
+	for ; j < len(y); j++ {
+		out = append(out, "+"+y[j])
+	}
+	return out
+}
+
+func init() {
+	mergeCmd.Flags().StringArrayVarP(&mergeFiles, "filename", "f", nil, "Secret/ConfigMap manifest files or directories")
+	mergeCmd.Flags().BoolVar(&mergeDiff, "diff", false, "print the diff against the current primary content")
+	_ = mergeCmd.MarkFlagRequired("filename")
+	rootCmd.AddCommand(mergeCmd)
+}
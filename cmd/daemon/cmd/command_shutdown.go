@@ -4,20 +4,74 @@
 package cmd
 
 import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+
 	"github.com/spf13/cobra"
+	"github.com/yylt/kmerge/pkg/resource"
 	"k8s.io/klog/v2"
 )
 
+var (
+	shutdownSocket  string
+	shutdownTimeout time.Duration
+)
+
 // shutdownCmd represents the shutdown command.
 var shutdownCmd = &cobra.Command{
 	Use:   "shutdown",
 	Short: "shutdown " + binNameController,
 	Run: func(cmd *cobra.Command, args []string) {
-		// TODO (Icarus9913)
 		klog.Infof("Shutdown %s...", binNameController)
+
+		report, err := requestShutdown(shutdownSocket, shutdownTimeout)
+		if err != nil {
+			klog.Exitf("Failed to shutdown %s: %v", binNameController, err)
+		}
+		if len(report.Running) == 0 && len(report.Queued) == 0 {
+			klog.Infof("%s drained", binNameController)
+			return
+		}
+		klog.Warningf("%s shutdown with pending merges, running: %v, queued: %v", binNameController, report.Running, report.Queued)
 	},
 }
 
+// requestShutdown asks the daemon to drain and exit, and returns the merges
+// which were still pending.
+func requestShutdown(socket string, timeout time.Duration) (*resource.DrainReport, error) {
+	// leave some time for the daemon to write the report
+	cli := controlClient(socket, timeout+5*time.Second)
+	u := url.URL{
+		Scheme:   "http",
+		Host:     "kmerge",
+		Path:     controlShutdownPath,
+		RawQuery: url.Values{"timeout": []string{timeout.String()}}.Encode(),
+	}
+	resp, err := cli.Post(u.String(), "", nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s: %s", resp.Status, body)
+	}
+	report := &resource.DrainReport{}
+	if err = json.Unmarshal(body, report); err != nil {
+		return nil, err
+	}
+	return report, nil
+}
+
 func init() {
+	shutdownCmd.Flags().StringVar(&shutdownSocket, "control-socket", defaultControlSocket, "unix socket of the local control api")
+	shutdownCmd.Flags().DurationVar(&shutdownTimeout, "timeout", defaultShutdownTimeout, "maximum time to wait for in-flight merges")
 	rootCmd.AddCommand(shutdownCmd)
 }
@@ -9,9 +9,13 @@ import (
 	"os"
 	"strconv"
 	"strings"
+	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/spf13/pflag"
+	"github.com/yylt/kmerge/pkg/notify"
+	"github.com/yylt/kmerge/pkg/resource"
 	"gopkg.in/yaml.v3"
 	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/kubernetes"
@@ -21,6 +25,11 @@ import (
 
 var controllerContext = new(ControllerContext)
 
+const (
+	defaultControlSocket  = "/var/run/kmerge/control.sock"
+	defaultWebhookCertDir = "/tmp/k8s-webhook-server/serving-certs"
+)
+
 type envConf struct {
 	envName          string
 	defaultValue     string
@@ -33,15 +42,62 @@ type envConf struct {
 // EnvInfo collects the env and relevant agentContext properties.
 var envInfo = []envConf{
 	{"GOLANG_ENV_MAXPROCS", "8", false, nil, nil, &controllerContext.Cfg.GoMaxProcs},
+	{"POD_NAME", "", false, &controllerContext.Cfg.PodName, nil, nil},
+	{"POD_NAMESPACE", "", false, &controllerContext.Cfg.PodNamespace, nil, nil},
 }
 
 type Config struct {
-	GoMaxProcs int
+	GoMaxProcs   int
+	PodName      string
+	PodNamespace string
 
 	// flags
 	ConfigPath       string
 	GopsListenPort   string
 	PyroscopeAddress string
+	HealthProbePort  string
+	ControlSocket    string
+
+	// ShutdownGracePeriod is the maximum time to wait for in-flight merges
+	// on termination.
+	ShutdownGracePeriod time.Duration
+
+	// leader election, the lease namespace defaults to the pod namespace
+	LeaderElection          bool
+	LeaderElectionNamespace string
+	LeaseDuration           time.Duration
+	RenewDeadline           time.Duration
+	RetryPeriod             time.Duration
+
+	// failed merges are retried with per primary exponential delay
+	MergeRetryBaseDelay time.Duration
+	MergeRetryMaxDelay  time.Duration
+	MergeRetryAttempts  int
+
+	// Sharding spreads primaries over all replicas instead of electing a
+	// leader, membership uses the same lease timing as leader election.
+	Sharding bool
+
+	// ResyncInterval is the interval to recompute every primary and merge
+	// the drifted ones again, 0 disables resync.
+	ResyncInterval time.Duration
+
+	// WatchNamespaces restricts the cache and merges to the namespaces,
+	// empty means all namespaces. It is set by --watch-namespaces or in the
+	// config file.
+	WatchNamespaces []string `yaml:"watchNamespaces"`
+
+	// WebhookPort serves the validating admission webhook, 0 disables it.
+	// The serving certificate is issued into WebhookService-cert in the pod
+	// namespace, and its CA is injected into WebhookName.
+	WebhookPort    int
+	WebhookCertDir string
+	WebhookService string
+	WebhookName    string
+
+	// Webhooks are posted the result of every merge, they are only set in
+	// the config file.
+	Webhooks []notify.Endpoint `yaml:"webhooks"`
 }
 
 type ControllerContext struct {
@@ -59,6 +115,22 @@ type ControllerContext struct {
 	CRDManager manager.Manager
 	// probe
 	IsStartupProbe atomic.Bool
+
+	// Secret is the manager merging secrets.
+	Secret secretManager
+
+	drainOnce   sync.Once
+	drainReport resource.DrainReport
+}
+
+type secretManager interface {
+	Drain(ctx context.Context) resource.DrainReport
+
+	Primaries() []resource.PrimaryStatus
+	Sources(key string) ([]resource.SourceStatus, error)
+	Remerge(ctx context.Context, key string) error
+	Pause(key string) error
+	Resume(key string) error
 }
 
 // BindControllerDaemonFlags bind controller cli daemon flags
@@ -66,6 +138,27 @@ func (cc *ControllerContext) BindControllerDaemonFlags(flags *pflag.FlagSet) {
 	flags.StringVar(&cc.Cfg.ConfigPath, "config-path", "", "controller configmap file")
 	flags.StringVar(&cc.Cfg.GopsListenPort, "gops-port", "5724", "gops listen port")
 	flags.StringVar(&cc.Cfg.PyroscopeAddress, "pyroscope-address", "", "pyroscope address")
+	flags.StringVar(&cc.Cfg.HealthProbePort, "health-port", "5725", "healthz and readyz listen port")
+	flags.StringVar(&cc.Cfg.ControlSocket, "control-socket", defaultControlSocket, "unix socket of the local control api")
+	flags.DurationVar(&cc.Cfg.ShutdownGracePeriod, "shutdown-grace-period", defaultShutdownTimeout, "maximum time to wait for in-flight merges on termination")
+
+	flags.DurationVar(&cc.Cfg.MergeRetryBaseDelay, "merge-retry-base-delay", time.Second, "initial delay to retry a failed merge, doubled on every failure")
+	flags.DurationVar(&cc.Cfg.MergeRetryMaxDelay, "merge-retry-max-delay", 5*time.Minute, "maximum delay to retry a failed merge")
+	flags.IntVar(&cc.Cfg.MergeRetryAttempts, "merge-retry-attempts", 10, "maximum retries of a failed merge until the primary is triggered again")
+
+	flags.BoolVar(&cc.Cfg.LeaderElection, "leader-elect", true, "enable lease based leader election")
+	flags.StringVar(&cc.Cfg.LeaderElectionNamespace, "leader-elect-namespace", "", "namespace of the leader election lease, default is the pod namespace")
+	flags.DurationVar(&cc.Cfg.LeaseDuration, "leader-elect-lease-duration", 15*time.Second, "duration that followers wait before forcing to acquire the lease")
+	flags.DurationVar(&cc.Cfg.RenewDeadline, "leader-elect-renew-deadline", 10*time.Second, "duration that the leader retries refreshing the lease before giving up")
+	flags.DurationVar(&cc.Cfg.RetryPeriod, "leader-elect-retry-period", 2*time.Second, "duration between leader election attempts")
+	flags.BoolVar(&cc.Cfg.Sharding, "sharding", false, "shard primaries across all replicas, leader election is disabled in this mode")
+	flags.DurationVar(&cc.Cfg.ResyncInterval, "resync-interval", 10*time.Minute, "interval to recompute every primary and correct drift, 0 disables resync")
+	flags.StringSliceVar(&cc.Cfg.WatchNamespaces, "watch-namespaces", nil, "namespaces to watch and merge in, default is all namespaces")
+
+	flags.IntVar(&cc.Cfg.WebhookPort, "webhook-port", 0, "port of the validating admission webhook, 0 disables the webhook")
+	flags.StringVar(&cc.Cfg.WebhookCertDir, "webhook-cert-dir", defaultWebhookCertDir, "directory to write the self-managed serving certificate of the webhook")
+	flags.StringVar(&cc.Cfg.WebhookService, "webhook-service", "kmerge-webhook", "service of the webhook in the pod namespace, which the certificate is issued for")
+	flags.StringVar(&cc.Cfg.WebhookName, "webhook-name", "kmerge-validating", "ValidatingWebhookConfiguration to inject the CA into")
 }
 
 // ParseConfiguration set the env to AgentConfiguration
@@ -114,6 +207,22 @@ func ParseConfiguration() error {
 // verify after retrieve all config
 func (cc *ControllerContext) Verify() {
 	// loglevel
+
+	if cc.Cfg.Sharding && cc.Cfg.LeaderElection {
+		klog.Warning("sharding is enabled, disable leader election")
+		cc.Cfg.LeaderElection = false
+	}
+	if cc.Cfg.WebhookPort > 0 && cc.Cfg.PodNamespace == "" {
+		klog.Exitf("webhook requires the pod namespace to keep its certificate")
+	}
+	if cc.Cfg.LeaderElection || cc.Cfg.Sharding {
+		if cc.Cfg.RenewDeadline >= cc.Cfg.LeaseDuration {
+			klog.Exitf("leader election renew deadline %v must be less than lease duration %v", cc.Cfg.RenewDeadline, cc.Cfg.LeaseDuration)
+		}
+		if cc.Cfg.RetryPeriod >= cc.Cfg.RenewDeadline {
+			klog.Exitf("leader election retry period %v must be less than renew deadline %v", cc.Cfg.RetryPeriod, cc.Cfg.RenewDeadline)
+		}
+	}
 }
 
 // LoadConfigmap reads configmap data from cli flag config-path
@@ -0,0 +1,160 @@
+// Copyright 2023 Authors of kmerge
+// SPDX-License-Identifier: Apache-2.0
+
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/yylt/kmerge/pkg/resource"
+	"k8s.io/klog/v2"
+)
+
+const (
+	controlShutdownPath  = "/shutdown"
+	controlPrimariesPath = "/primaries"
+
+	defaultShutdownTimeout = 25 * time.Second
+)
+
+// startControlServer serves the control and admin api on a unix socket, it is
+// only reachable from inside the pod, e.g.
+//
+//	curl --unix-socket /var/run/kmerge/control.sock http://kmerge/primaries
+func startControlServer(cc *ControllerContext) (*http.Server, error) {
+	socket := cc.Cfg.ControlSocket
+	if err := os.MkdirAll(filepath.Dir(socket), 0o700); err != nil {
+		return nil, fmt.Errorf("failed to create control socket dir: %v", err)
+	}
+	if err := os.Remove(socket); err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to remove stale control socket: %v", err)
+	}
+	ln, err := net.Listen("unix", socket)
+	if err != nil {
+		return nil, fmt.Errorf("control failed to listen on %s: %v", socket, err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(controlShutdownPath, func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		timeout := cc.Cfg.ShutdownGracePeriod
+		if v := req.URL.Query().Get("timeout"); v != "" {
+			d, err := time.ParseDuration(v)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("invalid timeout %q: %v", v, err), http.StatusBadRequest)
+				return
+			}
+			timeout = d
+		}
+		writeJSON(w, cc.Drain(timeout))
+		// exit after the report is sent, leadership is released on cancel
+		go cc.InnerCancel()
+	})
+
+	mux.HandleFunc(controlPrimariesPath, func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		writeJSON(w, cc.Secret.Primaries())
+	})
+	mux.HandleFunc(controlPrimariesPath+"/", func(w http.ResponseWriter, req *http.Request) {
+		servePrimary(cc.Secret, w, req)
+	})
+
+	srv := &http.Server{
+		Handler:           mux,
+		ReadHeaderTimeout: 5 * time.Second,
+	}
+	go func() {
+		if err := srv.Serve(ln); err != nil && err != http.ErrServerClosed {
+			klog.Errorf("control server failed: %v", err)
+		}
+	}()
+	klog.Infof("control is listen on %s", socket)
+	return srv, nil
+}
+
+// servePrimary serves /primaries/<namespace>/<name>/<action>, actions are
+// sources (GET), merge, pause and resume (POST).
+func servePrimary(sm secretManager, w http.ResponseWriter, req *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(req.URL.Path, controlPrimariesPath+"/"), "/")
+	if len(parts) != 3 || parts[0] == "" || parts[1] == "" {
+		http.NotFound(w, req)
+		return
+	}
+	var (
+		key    = parts[0] + "/" + parts[1]
+		action = parts[2]
+		method = http.MethodPost
+		err    error
+	)
+	if action == "sources" {
+		method = http.MethodGet
+	}
+	if req.Method != method {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	switch action {
+	case "sources":
+		var sources []resource.SourceStatus
+		sources, err = sm.Sources(key)
+		if err == nil {
+			writeJSON(w, sources)
+			return
+		}
+	case "merge":
+		err = sm.Remerge(req.Context(), key)
+	case "pause":
+		err = sm.Pause(key)
+	case "resume":
+		err = sm.Resume(key)
+	default:
+		http.NotFound(w, req)
+		return
+	}
+	switch {
+	case errors.Is(err, resource.ErrPrimaryNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case errors.Is(err, resource.ErrPrimaryNotOwned):
+		http.Error(w, err.Error(), http.StatusConflict)
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	default:
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		klog.Errorf("write control response failed: %v", err)
+	}
+}
+
+// controlClient returns a http client which dials the control socket.
+func controlClient(socket string, timeout time.Duration) *http.Client {
+	return &http.Client{
+		Timeout: timeout,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", socket)
+			},
+		},
+	}
+}
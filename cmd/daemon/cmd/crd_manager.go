@@ -4,7 +4,10 @@
 package cmd
 
 import (
+	"context"
+
 	"github.com/go-logr/logr"
+	"github.com/yylt/kmerge/pkg/resource"
 	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
@@ -13,8 +16,8 @@ import (
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/cache"
 	"sigs.k8s.io/controller-runtime/pkg/client"
-	"sigs.k8s.io/controller-runtime/pkg/healthz"
 	metricsserver "sigs.k8s.io/controller-runtime/pkg/metrics/server"
+	"sigs.k8s.io/controller-runtime/pkg/webhook"
 )
 
 var scheme = runtime.NewScheme()
@@ -23,41 +26,82 @@ func init() {
 	utilruntime.Must(clientgoscheme.AddToScheme(scheme))
 }
 
-func newCRDManager(cfg *Config) (ctrl.Manager, error) {
+func newCRDManager(cfg *Config) (ctrl.Manager, *leaderStatus, error) {
 
 	config := ctrl.GetConfigOrDie()
 	config.Burst = 200
 	config.QPS = 100
 
-	// cache read node, the node just use matedata
+	// cache read node, the node just use matedata. secrets are cached as
+	// metadata only, and read from apiserver when merged.
 	cacheopt := cache.Options{
 		Scheme: scheme,
 		ByObject: map[client.Object]cache.ByObject{
 			&corev1.ConfigMap{}: {},
-			&corev1.Secret{}:    {},
 			&corev1.Namespace{}: {},
 		},
 	}
+	if len(cfg.WatchNamespaces) > 0 {
+		cacheopt.DefaultNamespaces = map[string]cache.Config{}
+		for _, ns := range cfg.WatchNamespaces {
+			cacheopt.DefaultNamespaces[ns] = cache.Config{}
+		}
+	}
 
-	mgr, err := ctrl.NewManager(config, ctrl.Options{
+	opt := ctrl.Options{
 		Scheme: scheme,
 		Logger: logr.Discard(),
 		Cache:  cacheopt,
+		Client: client.Options{
+			Cache: &client.CacheOptions{
+				DisableFor: []client.Object{&corev1.Secret{}},
+			},
+		},
 		Metrics: metricsserver.Options{
 			BindAddress: "0",
 		},
-	})
-	if err != nil {
-		return nil, err
 	}
 
-	if err := mgr.AddHealthzCheck("healthz", healthz.Ping); err != nil {
-		klog.Exitf("unable to set up health check: %s", err)
+	if cfg.WebhookPort > 0 {
+		opt.WebhookServer = webhook.NewServer(webhook.Options{
+			Port:    cfg.WebhookPort,
+			CertDir: cfg.WebhookCertDir,
+		})
+	}
+
+	leader := &leaderStatus{}
+	if cfg.LeaderElection {
+		lock, err := newLeaderLock(cfg)
+		if err != nil {
+			return nil, nil, err
+		}
+		leader.lock = lock
+		opt.LeaderElection = true
+		opt.LeaderElectionID = leaderElectionID
+		opt.LeaderElectionResourceLockInterface = lock
+		// the process exits right after the manager stops
+		opt.LeaderElectionReleaseOnCancel = true
+		opt.LeaseDuration = &cfg.LeaseDuration
+		opt.RenewDeadline = &cfg.RenewDeadline
+		opt.RetryPeriod = &cfg.RetryPeriod
 	}
 
-	if err := mgr.AddReadyzCheck("readyz", healthz.Ping); err != nil {
-		klog.Errorf("unable to set up ready check: %s", err)
+	mgr, err := ctrl.NewManager(config, opt)
+	if err != nil {
+		return nil, nil, err
 	}
+	leader.elected = mgr.Elected()
+
+	// followers do not start controllers, register the informer here so
+	// the cache is warm when it takes over the lease.
+	if _, err = mgr.GetCache().GetInformer(context.Background(), resource.SecretMeta()); err != nil {
+		return nil, nil, err
+	}
+
+	go func() {
+		<-leader.elected
+		klog.Infof("%s is elected as leader", leader.Identity())
+	}()
 
-	return mgr, nil
+	return mgr, leader, nil
 }
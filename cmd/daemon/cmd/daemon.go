@@ -10,14 +10,19 @@ import (
 	"os/signal"
 	"runtime"
 	"syscall"
+	"time"
 
 	"github.com/google/gops/agent"
 	"github.com/grafana/pyroscope-go"
+	"github.com/yylt/kmerge/pkg/admission"
+	"github.com/yylt/kmerge/pkg/notify"
 	"github.com/yylt/kmerge/pkg/resource"
+	"github.com/yylt/kmerge/pkg/shard"
 	"github.com/yylt/kmerge/version"
 	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/kubernetes"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/webhook"
 
 	"k8s.io/klog/v2"
 )
@@ -44,6 +49,7 @@ func DaemonMain() {
 	if err := controllerContext.LoadConfigmap(); err != nil {
 		klog.Warning(err)
 	}
+	controllerContext.Verify()
 	klog.Infof("controller config: %+v", controllerContext.Cfg)
 
 	// Set up gops.
@@ -100,16 +106,31 @@ func DaemonMain() {
 	controllerContext.DynamicClient = dynamicClient
 
 	klog.Info("Begin to initialize controller runtime manager")
-	mgr, err := newCRDManager(&controllerContext.Cfg)
+	mgr, leader, err := newCRDManager(&controllerContext.Cfg)
 	if nil != err {
 		klog.Fatal(err.Error())
 	}
 	controllerContext.CRDManager = mgr
 
+	if err = startProbeServer(controllerContext.InnerCtx, controllerContext, leader); err != nil {
+		klog.Fatal(err.Error())
+	}
+
 	// init managers...
 	initControllerServiceManagers(controllerContext)
 
+	if err = initWebhook(controllerContext); err != nil {
+		klog.Fatal(err.Error())
+	}
+
+	control, err := startControlServer(controllerContext)
+	if err != nil {
+		klog.Fatal(err.Error())
+	}
+
+	mgrDone := make(chan struct{})
 	go func() {
+		defer close(mgrDone)
 		klog.Info("Starting controller runtime manager")
 		if err := mgr.Start(controllerContext.InnerCtx); err != nil {
 			klog.Fatal(err.Error())
@@ -119,10 +140,32 @@ func DaemonMain() {
 	if !waitForCacheSync {
 		klog.Fatal("failed to wait for syncing controller-runtime cache")
 	}
+	controllerContext.IsStartupProbe.Store(true)
 
 	sigCh := make(chan os.Signal, 1)
 	signal.Notify(sigCh, syscall.SIGTERM, syscall.SIGINT)
-	WatchSignal(sigCh)
+	go WatchSignal(sigCh)
+
+	<-mgrDone
+	// let the shutdown command receive its report
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_ = control.Shutdown(ctx)
+	klog.Info("controller runtime manager stopped, exit")
+}
+
+// Drain stops merging and waits for the in-flight merges at most timeout.
+// It only runs once, later calls return the first report.
+func (cc *ControllerContext) Drain(timeout time.Duration) resource.DrainReport {
+	cc.drainOnce.Do(func() {
+		if cc.Secret == nil {
+			return
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		cc.drainReport = cc.Secret.Drain(ctx)
+	})
+	return cc.drainReport
 }
 
 // WatchSignal notifies the signal to shut down controllerContext handlers.
@@ -130,6 +173,10 @@ func WatchSignal(sigCh chan os.Signal) {
 	for sig := range sigCh {
 		klog.Warning("received shutdown", " signal ", sig)
 
+		// Refuse new merges and let the running ones finish, so no patch is
+		// aborted halfway.
+		controllerContext.Drain(controllerContext.Cfg.ShutdownGracePeriod)
+
 		// Cancel the internal context of controller.
 		if controllerContext.InnerCancel != nil {
 			controllerContext.InnerCancel()
@@ -139,10 +186,80 @@ func WatchSignal(sigCh chan os.Signal) {
 }
 
 func initControllerServiceManagers(ctrlctx *ControllerContext) {
-	_, err := resource.NewSecret(ctrlctx.CRDManager, ctrlctx.InnerCtx, 5)
+	cfg := &ctrlctx.Cfg
+	opts := []resource.Option{
+		resource.WithRetry(cfg.MergeRetryBaseDelay, cfg.MergeRetryMaxDelay, cfg.MergeRetryAttempts),
+		resource.WithResync(cfg.ResyncInterval),
+	}
+
+	members, err := newMembership(ctrlctx)
+	if err != nil {
+		panic(err)
+	}
+	if members != nil {
+		opts = append(opts, resource.WithSharder(members))
+	}
+	if len(cfg.WatchNamespaces) > 0 {
+		opts = append(opts, resource.WithNamespaces(cfg.WatchNamespaces...))
+	}
+	if len(cfg.Webhooks) > 0 {
+		hooks, err := notify.NewWebhooks(cfg.Webhooks)
+		if err != nil {
+			panic(err)
+		}
+		hooks.Start(ctrlctx.InnerCtx)
+		opts = append(opts, resource.WithNotifier(hooks))
+	}
+	secret, err := resource.NewSecret(ctrlctx.CRDManager, ctrlctx.InnerCtx, 5, opts...)
 	if err != nil {
 		panic(err)
 	}
+	if members != nil {
+		members.OnChange(secret.Rebalance)
+		go members.Start(ctrlctx.InnerCtx)
+	}
+	ctrlctx.Secret = secret
+}
+
+// initWebhook issues the serving certificate and registers the validating
+// webhook, the server is started with the manager. The index of the secret
+// manager must be registered before.
+func initWebhook(ctrlctx *ControllerContext) error {
+	cfg := &ctrlctx.Cfg
+	if cfg.WebhookPort <= 0 {
+		return nil
+	}
+	certs := &admission.Certs{
+		Client:      ctrlctx.ClientSet,
+		Namespace:   cfg.PodNamespace,
+		Service:     cfg.WebhookService,
+		SecretName:  cfg.WebhookService + "-cert",
+		WebhookName: cfg.WebhookName,
+		CertDir:     cfg.WebhookCertDir,
+	}
+	if err := certs.Ensure(ctrlctx.InnerCtx); err != nil {
+		return fmt.Errorf("failed to ensure webhook certificates: %v", err)
+	}
+	go certs.Start(ctrlctx.InnerCtx, 12*time.Hour)
+
+	mgr := ctrlctx.CRDManager
+	mgr.GetWebhookServer().Register(admission.ValidatePath, &webhook.Admission{
+		Handler: admission.NewValidator(mgr.GetScheme(), mgr.GetCache(), mgr.GetAPIReader()),
+	})
+	return nil
+}
+
+// newMembership returns the shard membership, nil if sharding is disabled.
+func newMembership(ctrlctx *ControllerContext) (*shard.Membership, error) {
+	cfg := &ctrlctx.Cfg
+	if !cfg.Sharding {
+		return nil, nil
+	}
+	ns, id, err := cfg.leaseIdentity()
+	if err != nil {
+		return nil, err
+	}
+	return shard.NewMembership(ctrlctx.ClientSet.CoordinationV1(), ns, leaderElectionID, id, cfg.LeaseDuration, cfg.RetryPeriod)
 }
 
 // initK8sClientSet will new kubernetes Clientset
@@ -0,0 +1,101 @@
+// Copyright 2023 Authors of kmerge
+// SPDX-License-Identifier: Apache-2.0
+
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+	"k8s.io/klog/v2"
+	ctrl "sigs.k8s.io/controller-runtime"
+)
+
+const leaderElectionID = "kmerge-controller"
+
+// leaderStatus reports the leader election state of this replica.
+type leaderStatus struct {
+	lock    resourcelock.Interface
+	elected <-chan struct{}
+}
+
+// newLeaderLock returns the lease lock used for leader election. The pod name is
+// used as identity, so the lease holder tells which replica is the leader.
+func newLeaderLock(cfg *Config) (resourcelock.Interface, error) {
+	ns, id, err := cfg.leaseIdentity()
+	if err != nil {
+		return nil, err
+	}
+
+	clientSet, err := kubernetes.NewForConfig(ctrl.GetConfigOrDie())
+	if err != nil {
+		return nil, fmt.Errorf("failed to init leader election clientset: %v", err)
+	}
+	return resourcelock.New(resourcelock.LeasesResourceLock,
+		ns,
+		leaderElectionID,
+		clientSet.CoreV1(),
+		clientSet.CoordinationV1(),
+		resourcelock.ResourceLockConfig{
+			Identity: id,
+		})
+}
+
+// leaseIdentity returns the namespace of the leases and the identity of this
+// replica, which is the pod name or the hostname.
+func (cfg *Config) leaseIdentity() (string, string, error) {
+	ns := cfg.LeaderElectionNamespace
+	if ns == "" {
+		ns = cfg.PodNamespace
+	}
+	if ns == "" {
+		return "", "", fmt.Errorf("lease namespace is empty, set it by flag or POD_NAMESPACE env")
+	}
+	id := cfg.PodName
+	if id == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return "", "", fmt.Errorf("failed to get hostname: %v", err)
+		}
+		id = hostname
+	}
+	return ns, id, nil
+}
+
+// Identity returns the identity of this replica, it is empty when leader
+// election is disabled.
+func (ls *leaderStatus) Identity() string {
+	if ls == nil || ls.lock == nil {
+		return ""
+	}
+	return ls.lock.Identity()
+}
+
+// IsLeader returns whether this replica is running the controllers.
+func (ls *leaderStatus) IsLeader() bool {
+	if ls == nil || ls.elected == nil {
+		return false
+	}
+	select {
+	case <-ls.elected:
+		return true
+	default:
+		return false
+	}
+}
+
+// Holder returns the identity recorded in the lease, which is the current leader.
+func (ls *leaderStatus) Holder(ctx context.Context) string {
+	if ls == nil || ls.lock == nil {
+		return ""
+	}
+	record, _, err := ls.lock.Get(ctx)
+	if err != nil {
+		klog.V(2).Infof("failed to get leader election record: %v", err)
+		return ""
+	}
+	return record.HolderIdentity
+}
@@ -0,0 +1,81 @@
+// Copyright 2023 Authors of kmerge
+// SPDX-License-Identifier: Apache-2.0
+
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"k8s.io/klog/v2"
+	"sigs.k8s.io/controller-runtime/pkg/healthz"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+)
+
+const (
+	leaderHeader   = "X-Kmerge-Leader"
+	isLeaderHeader = "X-Kmerge-Is-Leader"
+)
+
+// readyHandler serves readyz checks and reports the current leader.
+type readyHandler struct {
+	checks *healthz.Handler
+	leader *leaderStatus
+}
+
+func (h *readyHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	holder := h.leader.Holder(req.Context())
+	w.Header().Set(leaderHeader, holder)
+	w.Header().Set(isLeaderHeader, strconv.FormatBool(h.leader.IsLeader()))
+	h.checks.ServeHTTP(w, req)
+
+	if _, verbose := req.URL.Query()["verbose"]; verbose {
+		fmt.Fprintf(w, "leader: %s, self: %s\n", holder, h.leader.Identity())
+	}
+}
+
+// startProbeServer serves healthz, readyz and metrics on the health port.
+func startProbeServer(ctx context.Context, cc *ControllerContext, leader *leaderStatus) error {
+	address := ":" + cc.Cfg.HealthProbePort
+	ln, err := net.Listen("tcp", address)
+	if err != nil {
+		return fmt.Errorf("probe failed to listen on %s: %v", address, err)
+	}
+
+	ready := &healthz.Handler{Checks: map[string]healthz.Checker{
+		"startup": func(_ *http.Request) error {
+			if !cc.IsStartupProbe.Load() {
+				return fmt.Errorf("cache not synced")
+			}
+			return nil
+		},
+	}}
+	mux := http.NewServeMux()
+	mux.Handle("/healthz", http.StripPrefix("/healthz", &healthz.Handler{Checks: map[string]healthz.Checker{
+		"healthz": healthz.Ping,
+	}}))
+	mux.Handle("/readyz", http.StripPrefix("/readyz", &readyHandler{checks: ready, leader: leader}))
+	mux.Handle("/readyz/", http.StripPrefix("/readyz", &readyHandler{checks: ready, leader: leader}))
+	mux.Handle("/metrics", promhttp.HandlerFor(metrics.Registry, promhttp.HandlerOpts{}))
+
+	srv := &http.Server{
+		Handler:           mux,
+		ReadHeaderTimeout: 5 * time.Second,
+	}
+	go func() {
+		if err := srv.Serve(ln); err != nil && err != http.ErrServerClosed {
+			klog.Errorf("probe server failed: %v", err)
+		}
+	}()
+	go func() {
+		<-ctx.Done()
+		_ = srv.Close()
+	}()
+	klog.Infof("probe is listen on %s", address)
+	return nil
+}
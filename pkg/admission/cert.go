@@ -0,0 +1,379 @@
+// Copyright 2023 Authors of kmerge
+// SPDX-License-Identifier: Apache-2.0
+
+package admission
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/util/retry"
+	"k8s.io/klog/v2"
+	"k8s.io/utils/clock"
+)
+
+const (
+	caKeyKey = "ca.key"
+
+	// prevCAKey keeps the CA before rotation, it stays in the CA bundle
+	// until it expires, so the replicas serving a certificate signed by it
+	// are trusted until they load the new one
+	prevCAKey = "ca-previous.crt"
+
+	caValidity   = 10 * 365 * 24 * time.Hour
+	certValidity = 365 * 24 * time.Hour
+
+	// renewBefore is the time before expiry to issue a new certificate
+	renewBefore = 30 * 24 * time.Hour
+
+	// dataLink links to the directory of the files in CertDir
+	dataLink = "..data"
+)
+
+// Certs keeps the self-signed serving certificate of the webhook. The CA and
+// the certificate are kept in a Secret shared by all replicas, the
+// certificate is written into CertDir and the CA is injected into the
+// ValidatingWebhookConfiguration.
+type Certs struct {
+	Client kubernetes.Interface
+
+	// Namespace and Service of the webhook, the Secret is in Namespace
+	Namespace string
+	Service   string
+
+	// SecretName keeps the certificates
+	SecretName string
+
+	// WebhookName is the name of the ValidatingWebhookConfiguration
+	WebhookName string
+
+	CertDir string
+
+	// Clock is the time source, nil means the real clock
+	Clock clock.Clock
+}
+
+// Start ensures the certificates at interval until ctx is done, a new
+// certificate is issued before the current one expires.
+func (c *Certs) Start(ctx context.Context, interval time.Duration) {
+	for {
+		select {
+		case <-c.clock().After(interval):
+			if err := c.Ensure(ctx); err != nil {
+				klog.Errorf("ensure webhook certificates failed: %v", err)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (c *Certs) clock() clock.Clock {
+	if c.Clock == nil {
+		return clock.RealClock{}
+	}
+	return c.Clock
+}
+
+// Ensure issues the certificates if they are missing or expiring, writes them
+// into CertDir and injects the CA into the webhook configuration.
+func (c *Certs) Ensure(ctx context.Context) error {
+	secret, err := c.ensureSecret(ctx)
+	if err != nil {
+		return err
+	}
+	if err = c.writeFiles(secret); err != nil {
+		return err
+	}
+	return c.injectCA(ctx, c.bundle(secret))
+}
+
+// ensureSecret returns the valid certificates in the secret, issued if
+// needed. The secret is read again if another replica wrote it meanwhile.
+func (c *Certs) ensureSecret(ctx context.Context) (*corev1.Secret, error) {
+	var (
+		secrets = c.Client.CoreV1().Secrets(c.Namespace)
+		secret  *corev1.Secret
+	)
+	written := func(err error) bool {
+		return apierrors.IsConflict(err) || apierrors.IsAlreadyExists(err)
+	}
+	err := retry.OnError(retry.DefaultRetry, written, func() error {
+		cur, err := secrets.Get(ctx, c.SecretName, metav1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			cur = &corev1.Secret{
+				ObjectMeta: metav1.ObjectMeta{Name: c.SecretName, Namespace: c.Namespace},
+				Type:       corev1.SecretTypeTLS,
+			}
+			if err = c.issue(cur); err != nil {
+				return err
+			}
+			secret, err = secrets.Create(ctx, cur, metav1.CreateOptions{})
+			return err
+		}
+		if err != nil {
+			return err
+		}
+		if c.valid(cur) {
+			secret = cur
+			return nil
+		}
+		klog.Infof("webhook certificate in secret %s/%s is invalid or expiring, issue a new one", c.Namespace, c.SecretName)
+		if err = c.issue(cur); err != nil {
+			return err
+		}
+		secret, err = secrets.Update(ctx, cur, metav1.UpdateOptions{})
+		return err
+	})
+	return secret, err
+}
+
+// dnsNames are the names of the service.
+func (c *Certs) dnsNames() []string {
+	return []string{
+		c.Service,
+		fmt.Sprintf("%s.%s", c.Service, c.Namespace),
+		fmt.Sprintf("%s.%s.svc", c.Service, c.Namespace),
+	}
+}
+
+// valid returns whether the certificate in secret is signed by its CA, names
+// the service and is not expiring.
+func (c *Certs) valid(secret *corev1.Secret) bool {
+	pair, err := tls.X509KeyPair(secret.Data[corev1.TLSCertKey], secret.Data[corev1.TLSPrivateKeyKey])
+	if err != nil {
+		return false
+	}
+	cert, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return false
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(secret.Data[corev1.ServiceAccountRootCAKey]) {
+		return false
+	}
+	now := c.clock().Now()
+	_, err = cert.Verify(x509.VerifyOptions{
+		DNSName:     c.dnsNames()[2],
+		Roots:       pool,
+		CurrentTime: now.Add(renewBefore),
+	})
+	return err == nil
+}
+
+// issue signs a new certificate into secret, the CA is kept if it is valid.
+func (c *Certs) issue(secret *corev1.Secret) error {
+	now := c.clock().Now()
+	if secret.Data == nil {
+		secret.Data = map[string][]byte{}
+	}
+	ca, caKey, err := parseCA(secret.Data[corev1.ServiceAccountRootCAKey], secret.Data[caKeyKey])
+	if err != nil || now.Add(certValidity).After(ca.NotAfter) {
+		if ca != nil {
+			secret.Data[prevCAKey] = secret.Data[corev1.ServiceAccountRootCAKey]
+		}
+		ca, caKey, err = newCA(c.Service, now)
+		if err != nil {
+			return err
+		}
+		keyDER, err := x509.MarshalECPrivateKey(caKey)
+		if err != nil {
+			return err
+		}
+		secret.Data[corev1.ServiceAccountRootCAKey] = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.Raw})
+		secret.Data[caKeyKey] = pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: serial(),
+		Subject:      pkix.Name{CommonName: c.dnsNames()[2]},
+		DNSNames:     c.dnsNames(),
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(certValidity),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca, &key.PublicKey, caKey)
+	if err != nil {
+		return err
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+	secret.Data[corev1.TLSCertKey] = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	secret.Data[corev1.TLSPrivateKeyKey] = pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	return nil
+}
+
+// bundle returns the CA bundle of secret, which has the previous CA until it
+// expires.
+func (c *Certs) bundle(secret *corev1.Secret) []byte {
+	ca := secret.Data[corev1.ServiceAccountRootCAKey]
+	prev := secret.Data[prevCAKey]
+	block, _ := pem.Decode(prev)
+	if block == nil {
+		return ca
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil || !c.clock().Now().Before(cert.NotAfter) {
+		return ca
+	}
+	return append(bytes.Clone(ca), prev...)
+}
+
+func newCA(name string, now time.Time) (*x509.Certificate, *ecdsa.PrivateKey, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          serial(),
+		Subject:               pkix.Name{CommonName: name + "-ca"},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(caValidity),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	ca, err := x509.ParseCertificate(der)
+	return ca, key, err
+}
+
+func parseCA(certPEM, keyPEM []byte) (*x509.Certificate, *ecdsa.PrivateKey, error) {
+	certBlock, _ := pem.Decode(certPEM)
+	keyBlock, _ := pem.Decode(keyPEM)
+	if certBlock == nil || keyBlock == nil {
+		return nil, nil, fmt.Errorf("no ca")
+	}
+	ca, err := x509.ParseCertificate(certBlock.Bytes)
+	if err != nil {
+		return nil, nil, err
+	}
+	key, err := x509.ParseECPrivateKey(keyBlock.Bytes)
+	return ca, key, err
+}
+
+func serial() *big.Int {
+	n, _ := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	return n
+}
+
+// writeFiles writes the certificate into CertDir, unchanged files are not
+// written so the server does not reload them. The files are links through
+// dataLink into a directory of both, which is swapped by one rename, so the
+// server never loads the certificate with the key of another.
+func (c *Certs) writeFiles(secret *corev1.Secret) error {
+	keys := []string{corev1.TLSCertKey, corev1.TLSPrivateKeyKey}
+	if c.written(secret, keys) {
+		return nil
+	}
+	if err := os.MkdirAll(c.CertDir, 0o700); err != nil {
+		return err
+	}
+	dir, err := os.MkdirTemp(c.CertDir, "..certs-")
+	if err != nil {
+		return err
+	}
+	for _, k := range keys {
+		if err = os.WriteFile(filepath.Join(dir, k), secret.Data[k], 0o600); err != nil {
+			_ = os.RemoveAll(dir)
+			return err
+		}
+	}
+
+	data := filepath.Join(c.CertDir, dataLink)
+	old, _ := os.Readlink(data)
+	if err = replaceLink(data, filepath.Base(dir)); err != nil {
+		_ = os.RemoveAll(dir)
+		return err
+	}
+	for _, k := range keys {
+		path := filepath.Join(c.CertDir, k)
+		target := filepath.Join(dataLink, k)
+		if cur, err := os.Readlink(path); err == nil && cur == target {
+			continue
+		}
+		if err = replaceLink(path, target); err != nil {
+			return err
+		}
+	}
+	// the server watches the files it loaded, their removal makes it load
+	// the new ones
+	if old != "" {
+		return os.RemoveAll(filepath.Join(c.CertDir, old))
+	}
+	return nil
+}
+
+// written returns whether the files in CertDir have the keys of secret.
+func (c *Certs) written(secret *corev1.Secret, keys []string) bool {
+	for _, k := range keys {
+		cur, err := os.ReadFile(filepath.Join(c.CertDir, k))
+		if err != nil || !bytes.Equal(cur, secret.Data[k]) {
+			return false
+		}
+	}
+	return true
+}
+
+// replaceLink points the symlink path to target by rename.
+func replaceLink(path, target string) error {
+	tmp := path + ".tmp"
+	if err := os.Remove(tmp); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := os.Symlink(target, tmp); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// injectCA sets ca as the CA bundle of every webhook in the configuration.
+// The bundle is replaced, it holds the previous CA while rotating.
+func (c *Certs) injectCA(ctx context.Context, ca []byte) error {
+	if c.WebhookName == "" {
+		return nil
+	}
+	configs := c.Client.AdmissionregistrationV1().ValidatingWebhookConfigurations()
+	config, err := configs.Get(ctx, c.WebhookName, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+	changed := false
+	for i := range config.Webhooks {
+		if !bytes.Equal(config.Webhooks[i].ClientConfig.CABundle, ca) {
+			config.Webhooks[i].ClientConfig.CABundle = ca
+			changed = true
+		}
+	}
+	if !changed {
+		return nil
+	}
+	_, err = configs.Update(ctx, config, metav1.UpdateOptions{})
+	return err
+}
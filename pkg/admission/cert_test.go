@@ -0,0 +1,226 @@
+// Copyright 2023 Authors of kmerge
+// SPDX-License-Identifier: Apache-2.0
+
+package admission
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	admissionregistrationv1 "k8s.io/api/admissionregistration/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+	testingclock "k8s.io/utils/clock/testing"
+	"sigs.k8s.io/controller-runtime/pkg/certwatcher"
+)
+
+func TestCerts(t *testing.T) {
+	ctx := context.Background()
+	cli := fake.NewSimpleClientset(&admissionregistrationv1.ValidatingWebhookConfiguration{
+		ObjectMeta: metav1.ObjectMeta{Name: "kmerge-validating"},
+		Webhooks:   []admissionregistrationv1.ValidatingWebhook{{Name: "validate.kmerge.io"}},
+	})
+	fc := testingclock.NewFakeClock(time.Now())
+	c := &Certs{
+		Client:      cli,
+		Namespace:   "kmerge",
+		Service:     "kmerge-webhook",
+		SecretName:  "kmerge-webhook-cert",
+		WebhookName: "kmerge-validating",
+		CertDir:     t.TempDir(),
+		Clock:       fc,
+	}
+	assert.NoError(t, c.Ensure(ctx))
+
+	secret, err := cli.CoreV1().Secrets("kmerge").Get(ctx, "kmerge-webhook-cert", metav1.GetOptions{})
+	assert.NoError(t, err)
+	assert.True(t, c.valid(secret))
+	crt, err := os.ReadFile(filepath.Join(c.CertDir, corev1.TLSCertKey))
+	assert.NoError(t, err)
+	assert.Equal(t, secret.Data[corev1.TLSCertKey], crt)
+	config, err := cli.AdmissionregistrationV1().ValidatingWebhookConfigurations().Get(ctx, "kmerge-validating", metav1.GetOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, secret.Data[corev1.ServiceAccountRootCAKey], config.Webhooks[0].ClientConfig.CABundle)
+
+	block, _ := pem.Decode(crt)
+	cert, err := x509.ParseCertificate(block.Bytes)
+	assert.NoError(t, err)
+	assert.Contains(t, cert.DNSNames, "kmerge-webhook.kmerge.svc")
+
+	// kept while valid
+	assert.NoError(t, c.Ensure(ctx))
+	again, err := cli.CoreV1().Secrets("kmerge").Get(ctx, "kmerge-webhook-cert", metav1.GetOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, secret.Data, again.Data)
+
+	// renewed before expiry with the same CA
+	fc.Step(certValidity - renewBefore + time.Hour)
+	assert.NoError(t, c.Ensure(ctx))
+	renewed, err := cli.CoreV1().Secrets("kmerge").Get(ctx, "kmerge-webhook-cert", metav1.GetOptions{})
+	assert.NoError(t, err)
+	assert.NotEqual(t, secret.Data[corev1.TLSCertKey], renewed.Data[corev1.TLSCertKey])
+	assert.Equal(t, secret.Data[corev1.ServiceAccountRootCAKey], renewed.Data[corev1.ServiceAccountRootCAKey])
+	assert.True(t, c.valid(renewed))
+	crt, err = os.ReadFile(filepath.Join(c.CertDir, corev1.TLSCertKey))
+	assert.NoError(t, err)
+	assert.Equal(t, renewed.Data[corev1.TLSCertKey], crt)
+}
+
+func TestCertsRotateCA(t *testing.T) {
+	ctx := context.Background()
+	cli := fake.NewSimpleClientset(&admissionregistrationv1.ValidatingWebhookConfiguration{
+		ObjectMeta: metav1.ObjectMeta{Name: "kmerge-validating"},
+		Webhooks:   []admissionregistrationv1.ValidatingWebhook{{Name: "validate.kmerge.io"}},
+	})
+	fc := testingclock.NewFakeClock(time.Now())
+	c := &Certs{
+		Client:      cli,
+		Namespace:   "kmerge",
+		Service:     "kmerge-webhook",
+		SecretName:  "kmerge-webhook-cert",
+		WebhookName: "kmerge-validating",
+		CertDir:     t.TempDir(),
+		Clock:       fc,
+	}
+	assert.NoError(t, c.Ensure(ctx))
+	old, err := cli.CoreV1().Secrets("kmerge").Get(ctx, "kmerge-webhook-cert", metav1.GetOptions{})
+	assert.NoError(t, err)
+
+	// the CA is rotated once a certificate would outlive it
+	fc.Step(caValidity - certValidity + time.Hour)
+	assert.NoError(t, c.Ensure(ctx))
+	rotated, err := cli.CoreV1().Secrets("kmerge").Get(ctx, "kmerge-webhook-cert", metav1.GetOptions{})
+	assert.NoError(t, err)
+	assert.NotEqual(t, old.Data[corev1.ServiceAccountRootCAKey], rotated.Data[corev1.ServiceAccountRootCAKey])
+
+	// both CAs are trusted until the previous one expires
+	config, err := cli.AdmissionregistrationV1().ValidatingWebhookConfigurations().Get(ctx, "kmerge-validating", metav1.GetOptions{})
+	assert.NoError(t, err)
+	pool := x509.NewCertPool()
+	assert.True(t, pool.AppendCertsFromPEM(config.Webhooks[0].ClientConfig.CABundle))
+	for _, se := range []*corev1.Secret{old, rotated} {
+		block, _ := pem.Decode(se.Data[corev1.TLSCertKey])
+		cert, err := x509.ParseCertificate(block.Bytes)
+		assert.NoError(t, err)
+		_, err = cert.Verify(x509.VerifyOptions{Roots: pool, CurrentTime: cert.NotBefore.Add(time.Hour)})
+		assert.NoError(t, err)
+	}
+
+	fc.Step(certValidity)
+	assert.NoError(t, c.Ensure(ctx))
+	config, err = cli.AdmissionregistrationV1().ValidatingWebhookConfigurations().Get(ctx, "kmerge-validating", metav1.GetOptions{})
+	assert.NoError(t, err)
+	current, err := cli.CoreV1().Secrets("kmerge").Get(ctx, "kmerge-webhook-cert", metav1.GetOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, current.Data[corev1.ServiceAccountRootCAKey], config.Webhooks[0].ClientConfig.CABundle)
+}
+
+func TestCertsConflict(t *testing.T) {
+	ctx := context.Background()
+	cli := fake.NewSimpleClientset()
+	fc := testingclock.NewFakeClock(time.Now())
+	c := &Certs{
+		Client:     cli,
+		Namespace:  "kmerge",
+		Service:    "kmerge-webhook",
+		SecretName: "kmerge-webhook-cert",
+		CertDir:    t.TempDir(),
+		Clock:      fc,
+	}
+	assert.NoError(t, c.Ensure(ctx))
+	fc.Step(certValidity)
+
+	// the renewal races another replica, and is retried on the latest secret
+	conflicts := 0
+	cli.PrependReactor("update", "secrets", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		if conflicts > 0 {
+			return false, nil, nil
+		}
+		conflicts++
+		return true, nil, apierrors.NewConflict(corev1.Resource("secrets"), c.SecretName, errors.New("modified"))
+	})
+	assert.NoError(t, c.Ensure(ctx))
+	assert.Equal(t, 1, conflicts)
+
+	secret, err := cli.CoreV1().Secrets("kmerge").Get(ctx, "kmerge-webhook-cert", metav1.GetOptions{})
+	assert.NoError(t, err)
+	assert.True(t, c.valid(secret))
+	crt, err := os.ReadFile(filepath.Join(c.CertDir, corev1.TLSCertKey))
+	assert.NoError(t, err)
+	assert.Equal(t, secret.Data[corev1.TLSCertKey], crt)
+}
+
+func TestCertsWriteFiles(t *testing.T) {
+	c := &Certs{Namespace: "kmerge", Service: "kmerge-webhook", CertDir: t.TempDir()}
+	crt := filepath.Join(c.CertDir, corev1.TLSCertKey)
+	key := filepath.Join(c.CertDir, corev1.TLSPrivateKeyKey)
+	// written as plain files before
+	assert.NoError(t, os.WriteFile(crt, []byte("old"), 0o600))
+	assert.NoError(t, os.WriteFile(key, []byte("old"), 0o600))
+
+	dirs := func() []string {
+		matches, err := filepath.Glob(filepath.Join(c.CertDir, "..certs-*"))
+		assert.NoError(t, err)
+		return matches
+	}
+	secret := &corev1.Secret{}
+	for i := 0; i < 2; i++ {
+		assert.NoError(t, c.issue(secret))
+		assert.NoError(t, c.writeFiles(secret))
+
+		// both files are swapped together
+		pair, err := tls.LoadX509KeyPair(crt, key)
+		assert.NoError(t, err)
+		assert.Equal(t, secret.Data[corev1.TLSCertKey], pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: pair.Certificate[0]}))
+		for _, path := range []string{crt, key} {
+			fi, err := os.Lstat(path)
+			assert.NoError(t, err)
+			assert.Equal(t, os.ModeSymlink, fi.Mode().Type())
+		}
+		// the previous directory is removed
+		assert.Len(t, dirs(), 1)
+	}
+
+	// unchanged files are not written
+	before := dirs()
+	assert.NoError(t, c.writeFiles(secret))
+	assert.Equal(t, before, dirs())
+}
+
+func TestCertsWatcherReload(t *testing.T) {
+	c := &Certs{Namespace: "kmerge", Service: "kmerge-webhook", CertDir: t.TempDir()}
+	crt := filepath.Join(c.CertDir, corev1.TLSCertKey)
+	key := filepath.Join(c.CertDir, corev1.TLSPrivateKeyKey)
+	secret := &corev1.Secret{}
+	assert.NoError(t, c.issue(secret))
+	assert.NoError(t, c.writeFiles(secret))
+
+	watcher, err := certwatcher.New(crt, key)
+	assert.NoError(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() { _ = watcher.Start(ctx) }()
+
+	// renewed while served
+	time.Sleep(100 * time.Millisecond)
+	assert.NoError(t, c.issue(secret))
+	assert.NoError(t, c.writeFiles(secret))
+	block, _ := pem.Decode(secret.Data[corev1.TLSCertKey])
+	assert.Eventually(t, func() bool {
+		cert, err := watcher.GetCertificate(nil)
+		return err == nil && bytes.Equal(cert.Certificate[0], block.Bytes)
+	}, 5*time.Second, 10*time.Millisecond)
+}
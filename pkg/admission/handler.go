@@ -0,0 +1,111 @@
+// Copyright 2023 Authors of kmerge
+// SPDX-License-Identifier: Apache-2.0
+
+package admission
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/yylt/kmerge/pkg/resource"
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	ctrladmission "sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+)
+
+// ValidatePath is the path of the validating webhook.
+const ValidatePath = "/validate-kmerge"
+
+// Validator rejects Secrets and ConfigMaps with invalid kmerge annotations,
+// see resource.Validate.
+type Validator struct {
+	// cache lists the secret metadata of the groups
+	cache client.Reader
+
+	// reader reads the primaries merging a source
+	reader client.Reader
+
+	decoder *ctrladmission.Decoder
+}
+
+// NewValidator returns the validator, the groups are listed from cache, which
+// is indexed by the secret manager, and the primaries are read from reader.
+func NewValidator(scheme *runtime.Scheme, cache, reader client.Reader) *Validator {
+	return &Validator{
+		cache:   cache,
+		reader:  reader,
+		decoder: ctrladmission.NewDecoder(scheme),
+	}
+}
+
+// Handle implements admission.Handler. Updates are validated against the
+// old object, see resource.ValidateUpdate.
+func (v *Validator) Handle(ctx context.Context, req ctrladmission.Request) ctrladmission.Response {
+	if req.Operation == admissionv1.Delete {
+		return ctrladmission.Allowed("")
+	}
+	obj, err := v.decode(req.Kind.Kind, req.Object)
+	if err != nil {
+		return ctrladmission.Errored(http.StatusBadRequest, err)
+	}
+	if obj == nil {
+		return ctrladmission.Allowed("")
+	}
+
+	// configmaps are not merged by the controller, so there is no group to
+	// check
+	var cache client.Reader
+	if req.Kind.Kind == "Secret" {
+		cache = v.cache
+	}
+	var warnings []string
+	if req.Operation == admissionv1.Update && len(req.OldObject.Raw) > 0 {
+		var old *corev1.Secret
+		if old, err = v.decode(req.Kind.Kind, req.OldObject); err != nil {
+			return ctrladmission.Errored(http.StatusBadRequest, err)
+		}
+		warnings, err = resource.ValidateUpdate(ctx, cache, v.reader, old, obj)
+	} else {
+		warnings, err = resource.Validate(ctx, cache, v.reader, obj)
+	}
+	if err != nil {
+		return ctrladmission.Denied(err.Error()).WithWarnings(warnings...)
+	}
+	return ctrladmission.Allowed("").WithWarnings(warnings...)
+}
+
+// decode returns the Secret in raw, or the ConfigMap kept as a Secret, nil
+// for other kinds.
+func (v *Validator) decode(kind string, raw runtime.RawExtension) (*corev1.Secret, error) {
+	switch kind {
+	case "Secret":
+		se := &corev1.Secret{}
+		if err := v.decoder.DecodeRaw(raw, se); err != nil {
+			return nil, err
+		}
+		// same as the apiserver does
+		for k, val := range se.StringData {
+			if se.Data == nil {
+				se.Data = map[string][]byte{}
+			}
+			se.Data[k] = []byte(val)
+		}
+		return se, nil
+	case "ConfigMap":
+		cm := &corev1.ConfigMap{}
+		if err := v.decoder.DecodeRaw(raw, cm); err != nil {
+			return nil, err
+		}
+		se := &corev1.Secret{ObjectMeta: cm.ObjectMeta, Data: map[string][]byte{}}
+		for k, val := range cm.Data {
+			se.Data[k] = []byte(val)
+		}
+		for k, val := range cm.BinaryData {
+			se.Data[k] = val
+		}
+		return se, nil
+	}
+	return nil, nil
+}
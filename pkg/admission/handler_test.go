@@ -0,0 +1,101 @@
+// Copyright 2023 Authors of kmerge
+// SPDX-License-Identifier: Apache-2.0
+
+package admission
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/yylt/kmerge/pkg"
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	ctrladmission "sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+)
+
+func newRequest(t *testing.T, kind string, obj runtime.Object) ctrladmission.Request {
+	raw, err := json.Marshal(obj)
+	assert.NoError(t, err)
+	return ctrladmission.Request{AdmissionRequest: admissionv1.AdmissionRequest{
+		Operation: admissionv1.Create,
+		Kind:      metav1.GroupVersionKind{Version: "v1", Kind: kind},
+		Object:    runtime.RawExtension{Raw: raw},
+	}}
+}
+
+func TestValidator(t *testing.T) {
+	v := NewValidator(clientgoscheme.Scheme, nil, nil)
+	ctx := context.Background()
+
+	se := &corev1.Secret{ObjectMeta: metav1.ObjectMeta{
+		Namespace:   "a",
+		Name:        "src",
+		Annotations: map[string]string{pkg.KmergeNameKey: "group", pkg.KmergeTypeKey: "jsn"},
+	}}
+	resp := v.Handle(ctx, newRequest(t, "Secret", se))
+	assert.False(t, resp.Allowed)
+	assert.Contains(t, resp.Result.Message, `unknown kind "jsn"`)
+
+	// stringData is checked as data
+	se.Annotations[pkg.KmergeTypeKey] = "json"
+	se.StringData = map[string]string{"k": `{"a":`}
+	resp = v.Handle(ctx, newRequest(t, "Secret", se))
+	assert.False(t, resp.Allowed)
+
+	cm := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace:   "a",
+			Name:        "cm",
+			Annotations: map[string]string{pkg.KmergeNameKey: "group", "kmerge.io/unknown": ""},
+		},
+		Data: map[string]string{"k": "v"},
+	}
+	resp = v.Handle(ctx, newRequest(t, "ConfigMap", cm))
+	assert.True(t, resp.Allowed)
+	assert.Len(t, resp.Warnings, 1)
+
+	req := newRequest(t, "Secret", se)
+	req.Operation = admissionv1.Delete
+	assert.True(t, v.Handle(ctx, req).Allowed)
+}
+
+func TestValidatorUpdate(t *testing.T) {
+	v := NewValidator(clientgoscheme.Scheme, nil, nil)
+	ctx := context.Background()
+
+	// invalid before the webhook was installed
+	old := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace:   "p",
+			Name:        "primary",
+			Annotations: map[string]string{pkg.KmergePrimaryKey: "", pkg.KmergeNameKey: "group", pkg.KmergeModeKey: "dry"},
+		},
+		Data: map[string][]byte{"k": []byte("old")},
+	}
+	update := func(se *corev1.Secret) ctrladmission.Response {
+		req := newRequest(t, "Secret", se)
+		req.Operation = admissionv1.Update
+		raw, err := json.Marshal(old)
+		assert.NoError(t, err)
+		req.OldObject = runtime.RawExtension{Raw: raw}
+		return v.Handle(ctx, req)
+	}
+
+	// the merge writes the data and the hash
+	se := old.DeepCopy()
+	se.Data["k"] = []byte("new")
+	se.Annotations[pkg.KmergeHashKey] = "sum"
+	resp := update(se)
+	assert.True(t, resp.Allowed)
+	if assert.Len(t, resp.Warnings, 1) {
+		assert.Contains(t, resp.Warnings[0], `unknown mode "dry"`)
+	}
+
+	se.Annotations[pkg.KmergeFromNsKey] = "a"
+	assert.False(t, update(se).Allowed)
+}
@@ -24,6 +24,47 @@ const (
 	KmergeToNsKey = "namespace.kmerge.io/to"
 
 	KmergeHashKey = "kmerge.io/hash"
+
+	// merge mode of primary, support dry-run. default patch the primary
+	KmergeModeKey = "kmerge.io/mode"
+
+	// quiet period of primary, it is merged once no source changed for the
+	// duration, such as 5s. default merge on the first change
+	KmergeDebounceKey = "kmerge.io/debounce"
+
+	// max time a change of primary waits for the quiet period
+	KmergeMaxWaitKey = "kmerge.io/max-wait"
+
+	// policy of sources that fail to parse, support strict and skip-invalid.
+	// default strict fails the merge
+	KmergePolicyKey = "kmerge.io/policy"
+
+	// status annotation of primary, namespace/name of the sources skipped by
+	// the skip-invalid policy
+	KmergeSkippedKey = "kmerge.io/skipped"
+
+	// rollout workloads consuming the primary when its content changes, set
+	// "true" on the primary to opt in and "false" on a workload to opt out
+	KmergeRolloutKey = "kmerge.io/rollout"
+
+	// pod template annotation of the rolled out workloads, holds the hash of
+	// the primary
+	KmergeSecretHashKey = "kmerge.io/secret-hash"
+
+	// dry-run mode writes the merge result into a secret named with this suffix
+	KmergePreviewSuffix = ".kmerge-preview"
+)
+
+const (
+	// DryRunMode merges into the preview secret, and validates the primary
+	// patch by server-side dry-run
+	DryRunMode = "dry-run"
+
+	// StrictPolicy fails the merge on an invalid source
+	StrictPolicy = "strict"
+
+	// SkipInvalidPolicy merges the valid sources, and skips the invalid ones
+	SkipInvalidPolicy = "skip-invalid"
 )
 
 type Kind string
@@ -0,0 +1,277 @@
+// Copyright 2023 Authors of kmerge
+// SPDX-License-Identifier: Apache-2.0
+
+package notify
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cenkalti/backoff/v4"
+	"github.com/prometheus/client_golang/prometheus"
+	"k8s.io/klog/v2"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+)
+
+const (
+	// SignatureHeader carries the HMAC-SHA256 of the body as "sha256=<hex>",
+	// keyed by the secret of the endpoint.
+	SignatureHeader = "X-Kmerge-Signature"
+
+	// EventHeader carries the result of the merge.
+	EventHeader = "X-Kmerge-Event"
+
+	defaultTimeout = 5 * time.Second
+	defaultRetries = 3
+)
+
+// droppedEvents counts the events replaced by a newer event of the same
+// primary before they were posted.
+var droppedEvents = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "kmerge_webhook_events_dropped_total",
+	Help: "Number of events replaced by a newer event of the same primary before they were posted to the webhook.",
+}, []string{"url"})
+
+func init() {
+	metrics.Registry.MustRegister(droppedEvents)
+}
+
+// Result of a merge.
+const (
+	Changed   = "changed"
+	Unchanged = "unchanged"
+	Failed    = "failed"
+)
+
+// Event is the JSON payload posted after every merge.
+type Event struct {
+	// Primary is namespace/name of the primary.
+	Primary string `json:"primary"`
+
+	// Sources are namespace/name of the merged secrets, in merge order.
+	Sources []string `json:"sources"`
+
+	Result string `json:"result"`
+
+	// DryRun is set if the merge was written into the preview secret.
+	DryRun bool `json:"dryRun,omitempty"`
+
+	OldHash string `json:"oldHash,omitempty"`
+	NewHash string `json:"newHash,omitempty"`
+
+	Error string `json:"error,omitempty"`
+
+	Time time.Time `json:"time"`
+}
+
+// Endpoint is a webhook in the controller config.
+type Endpoint struct {
+	URL string `yaml:"url"`
+
+	// Secret signs the payload, SecretFile takes precedence and is read
+	// once on start. No signature header is sent without a secret.
+	Secret     string `yaml:"secret"`
+	SecretFile string `yaml:"secretFile"`
+
+	// Timeout of a post, default 5s.
+	Timeout time.Duration `yaml:"timeout"`
+
+	// Retries of a failed post, default 3.
+	Retries int `yaml:"retries"`
+}
+
+// Webhooks posts events to endpoints in the background, every endpoint has
+// its own queue so a slow one does not delay the others. The queue keeps the
+// latest event of every primary, so an endpoint falling behind gets the
+// newest result of each primary instead of every result.
+type Webhooks struct {
+	hooks []*hook
+}
+
+type hook struct {
+	Endpoint
+	secret []byte
+	client *http.Client
+
+	// retryInterval is the initial delay to retry a failed post
+	retryInterval time.Duration
+
+	mu sync.Mutex
+	// pending is the latest event of every primary not posted yet, order
+	// is the primaries in the order they were queued
+	pending map[string]Event
+	order   []string
+	wakeup  chan struct{}
+}
+
+// NewWebhooks returns the webhooks of endpoints, Start posts the events.
+func NewWebhooks(endpoints []Endpoint) (*Webhooks, error) {
+	w := &Webhooks{}
+	for _, ep := range endpoints {
+		if ep.URL == "" {
+			return nil, fmt.Errorf("webhook url must not be empty")
+		}
+		h := &hook{
+			Endpoint:      ep,
+			secret:        []byte(ep.Secret),
+			retryInterval: time.Second,
+			pending:       map[string]Event{},
+			wakeup:        make(chan struct{}, 1),
+		}
+		if ep.SecretFile != "" {
+			b, err := os.ReadFile(ep.SecretFile)
+			if err != nil {
+				return nil, fmt.Errorf("read secret of webhook %s: %v", ep.URL, err)
+			}
+			h.secret = bytes.TrimSpace(b)
+		}
+		if h.Timeout <= 0 {
+			h.Timeout = defaultTimeout
+		}
+		if h.Retries <= 0 {
+			h.Retries = defaultRetries
+		}
+		h.client = &http.Client{Timeout: h.Timeout}
+		w.hooks = append(w.hooks, h)
+	}
+	return w, nil
+}
+
+// Notify queues ev to every endpoint, it does not block.
+func (w *Webhooks) Notify(ev Event) {
+	if ev.Time.IsZero() {
+		ev.Time = time.Now()
+	}
+	for _, h := range w.hooks {
+		h.push(ev)
+	}
+}
+
+// Start posts the queued events until ctx is done.
+func (w *Webhooks) Start(ctx context.Context) {
+	for _, h := range w.hooks {
+		go h.run(ctx)
+	}
+}
+
+// push queues ev, replacing the pending event of the same primary.
+func (h *hook) push(ev Event) {
+	h.mu.Lock()
+	if old, ok := h.pending[ev.Primary]; ok {
+		droppedEvents.WithLabelValues(h.URL).Inc()
+		klog.V(2).Infof("webhook %s is behind, replace %s event of %s", h.URL, old.Result, ev.Primary)
+	} else {
+		h.order = append(h.order, ev.Primary)
+	}
+	h.pending[ev.Primary] = ev
+	h.mu.Unlock()
+
+	select {
+	case h.wakeup <- struct{}{}:
+	default:
+	}
+}
+
+// pop returns the oldest queued event.
+func (h *hook) pop() (Event, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if len(h.order) == 0 {
+		return Event{}, false
+	}
+	primary := h.order[0]
+	h.order = h.order[1:]
+	ev := h.pending[primary]
+	delete(h.pending, primary)
+	return ev, true
+}
+
+func (h *hook) run(ctx context.Context) {
+	for ctx.Err() == nil {
+		ev, ok := h.pop()
+		if !ok {
+			select {
+			case <-h.wakeup:
+			case <-ctx.Done():
+			}
+			continue
+		}
+		if err := h.send(ctx, ev); err != nil {
+			klog.Errorf("post event of %s to webhook %s failed: %v", ev.Primary, h.URL, err)
+		}
+	}
+}
+
+// send posts ev, retrying on network errors and 5xx or 429 responses.
+func (h *hook) send(ctx context.Context, ev Event) error {
+	body, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+	expbf := backoff.NewExponentialBackOff()
+	expbf.InitialInterval = h.retryInterval
+	expbf.MaxElapsedTime = 0
+	bo := backoff.WithContext(backoff.WithMaxRetries(expbf, uint64(h.Retries)), ctx)
+
+	return backoff.Retry(func() error {
+		return h.post(ctx, ev.Result, body)
+	}, bo)
+}
+
+func (h *hook) post(ctx context.Context, result string, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, h.URL, bytes.NewReader(body))
+	if err != nil {
+		return backoff.Permanent(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(EventHeader, result)
+	if len(h.secret) > 0 {
+		req.Header.Set(SignatureHeader, Sign(h.secret, body))
+	}
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	switch {
+	case resp.StatusCode < 300:
+		return nil
+	case resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests:
+		return fmt.Errorf("status %s", resp.Status)
+	default:
+		return backoff.Permanent(fmt.Errorf("status %s", resp.Status))
+	}
+}
+
+// Sign returns the signature header value of body.
+func Sign(secret, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Verify returns whether signature is the signature of body, receivers can
+// use it to check the header.
+func Verify(secret, body []byte, signature string) bool {
+	sum, ok := strings.CutPrefix(signature, "sha256=")
+	if !ok {
+		return false
+	}
+	got, err := hex.DecodeString(sum)
+	if err != nil {
+		return false
+	}
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(body)
+	return hmac.Equal(got, mac.Sum(nil))
+}
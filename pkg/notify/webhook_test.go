@@ -0,0 +1,137 @@
+// Copyright 2023 Authors of kmerge
+// SPDX-License-Identifier: Apache-2.0
+
+package notify
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWebhook(t *testing.T) {
+	var (
+		calls    atomic.Int32
+		received = make(chan Event, 1)
+		secret   = []byte("s3cret")
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// the first post fails, and is retried
+		if calls.Add(1) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		if !Verify(secret, body, r.Header.Get(SignatureHeader)) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		var ev Event
+		assert.NoError(t, json.Unmarshal(body, &ev))
+		assert.Equal(t, ev.Result, r.Header.Get(EventHeader))
+		received <- ev
+	}))
+	defer srv.Close()
+
+	hooks, err := NewWebhooks([]Endpoint{{URL: srv.URL, Secret: string(secret)}})
+	assert.NoError(t, err)
+	hooks.hooks[0].retryInterval = time.Millisecond
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	hooks.Start(ctx)
+
+	hooks.Notify(Event{
+		Primary: "p/primary",
+		Sources: []string{"a/src"},
+		Result:  Changed,
+		OldHash: "old",
+		NewHash: "new",
+	})
+	select {
+	case ev := <-received:
+		assert.Equal(t, "p/primary", ev.Primary)
+		assert.Equal(t, []string{"a/src"}, ev.Sources)
+		assert.Equal(t, "old", ev.OldHash)
+		assert.Equal(t, "new", ev.NewHash)
+		assert.False(t, ev.Time.IsZero())
+	case <-time.After(5 * time.Second):
+		t.Fatal("event is not received")
+	}
+	assert.Equal(t, int32(2), calls.Load())
+}
+
+func TestWebhookPermanentError(t *testing.T) {
+	var calls atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer srv.Close()
+
+	hooks, err := NewWebhooks([]Endpoint{{URL: srv.URL, Retries: 5}})
+	assert.NoError(t, err)
+	h := hooks.hooks[0]
+	h.retryInterval = time.Millisecond
+	assert.Error(t, h.send(context.Background(), Event{Primary: "p/primary", Result: Failed}))
+	assert.Equal(t, int32(1), calls.Load())
+}
+
+func TestWebhookRetries(t *testing.T) {
+	var calls atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		assert.Empty(t, r.Header.Get(SignatureHeader))
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer srv.Close()
+
+	hooks, err := NewWebhooks([]Endpoint{{URL: srv.URL, Retries: 2}})
+	assert.NoError(t, err)
+	h := hooks.hooks[0]
+	h.retryInterval = time.Millisecond
+	assert.Error(t, h.send(context.Background(), Event{Primary: "p/primary", Result: Unchanged}))
+	assert.Equal(t, int32(3), calls.Load())
+}
+
+func TestWebhookCoalesce(t *testing.T) {
+	hooks, err := NewWebhooks([]Endpoint{{URL: "http://coalesce.example.com"}})
+	assert.NoError(t, err)
+	h := hooks.hooks[0]
+
+	// the endpoint is behind, the newest event of every primary is kept
+	hooks.Notify(Event{Primary: "p/a", Result: Failed})
+	hooks.Notify(Event{Primary: "p/b", Result: Changed})
+	hooks.Notify(Event{Primary: "p/a", Result: Changed})
+	hooks.Notify(Event{Primary: "p/a", Result: Unchanged})
+	assert.Equal(t, float64(2), testutil.ToFloat64(droppedEvents.WithLabelValues(h.URL)))
+
+	var got []Event
+	for ev, ok := h.pop(); ok; ev, ok = h.pop() {
+		got = append(got, ev)
+	}
+	if assert.Len(t, got, 2) {
+		assert.Equal(t, "p/a", got[0].Primary)
+		assert.Equal(t, Unchanged, got[0].Result)
+		assert.Equal(t, "p/b", got[1].Primary)
+	}
+}
+
+func TestSign(t *testing.T) {
+	body := []byte(`{"primary":"p/primary"}`)
+	sig := Sign([]byte("key"), body)
+	assert.True(t, Verify([]byte("key"), body, sig))
+	assert.False(t, Verify([]byte("other"), body, sig))
+	assert.False(t, Verify([]byte("key"), []byte(`{}`), sig))
+	assert.False(t, Verify([]byte("key"), body, sig[len("sha256="):]))
+
+	_, err := NewWebhooks([]Endpoint{{}})
+	assert.Error(t, err)
+}
@@ -0,0 +1,199 @@
+// Copyright 2023 Authors of kmerge
+// SPDX-License-Identifier: Apache-2.0
+
+package resource
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/yylt/kmerge/pkg"
+	"github.com/yylt/kmerge/pkg/util"
+	"k8s.io/klog/v2"
+)
+
+// Merge states of a primary.
+const (
+	StateIdle    = "idle"
+	StateQueued  = "queued"
+	StateRunning = "running"
+	StatePaused  = "paused"
+	// the primary is merged by another replica
+	StateUnowned = "unowned"
+	// the manager is drained
+	StateStopped = "stopped"
+)
+
+var (
+	// ErrPrimaryNotFound is returned when the primary is not tracked.
+	ErrPrimaryNotFound = errors.New("primary not found")
+
+	// ErrPrimaryNotOwned is returned when the primary is merged by another
+	// replica.
+	ErrPrimaryNotOwned = errors.New("primary is merged by another replica")
+
+	errStopped = errors.New("secret manager is stopped")
+)
+
+// PrimaryStatus describes a tracked primary.
+type PrimaryStatus struct {
+	// namespace/name of the primary
+	Primary        string   `json:"primary"`
+	Name           string   `json:"name"`
+	Kind           pkg.Kind `json:"kind"`
+	FromNamespaces []string `json:"fromNamespaces,omitempty"`
+	State          string   `json:"state"`
+	// times the primary was found drifted by resync
+	Drifts int `json:"drifts,omitempty"`
+}
+
+// SourceStatus describes a secret merged into a primary.
+type SourceStatus struct {
+	// namespace/name of the source
+	Source          string `json:"source"`
+	ResourceVersion string `json:"resourceVersion"`
+}
+
+// Primaries returns every tracked primary, sorted by namespace/name.
+func (n *manager) Primaries() []PrimaryStatus {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+
+	list := make([]PrimaryStatus, 0, len(n.data))
+	for k, v := range n.data {
+		st := PrimaryStatus{
+			Primary: k,
+			Name:    v.name,
+			Kind:    v.k,
+			Drifts:  v.drifts,
+		}
+		for _, ns := range v.fromns.Values() {
+			st.FromNamespaces = append(st.FromNamespaces, ns.(string))
+		}
+		sort.Strings(st.FromNamespaces)
+		switch {
+		case v.paused:
+			st.State = StatePaused
+		case !v.scheduled:
+			st.State = StateUnowned
+		default:
+			st.State = n.work.state(k)
+		}
+		list = append(list, st)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Primary < list[j].Primary })
+	return list
+}
+
+// Sources returns the secrets currently matched for the primary, in merge order.
+func (n *manager) Sources(key string) ([]SourceStatus, error) {
+	se := n.getInfo(key)
+	if se == nil {
+		return nil, ErrPrimaryNotFound
+	}
+	infos, err := n.sources(se)
+	if err != nil {
+		return nil, err
+	}
+	list := make([]SourceStatus, 0, len(infos))
+	for _, v := range infos {
+		list = append(list, SourceStatus{
+			Source:          fmt.Sprintf("%s/%s", v.Namespace, v.Name),
+			ResourceVersion: v.ResourceVersion,
+		})
+	}
+	return list, nil
+}
+
+// Remerge merges the primary now and waits for the result until ctx is done.
+// The merge goes through the scheduler without the debounce of the primary,
+// so it never runs along with another merge of the primary. Paused primaries
+// are merged as well.
+func (n *manager) Remerge(ctx context.Context, key string) error {
+	done := make(chan error, 1)
+	n.mu.Lock()
+	se, ok := n.data[key]
+	switch {
+	case !ok:
+		n.mu.Unlock()
+		return ErrPrimaryNotFound
+	case !se.scheduled:
+		n.mu.Unlock()
+		return ErrPrimaryNotOwned
+	}
+	n.remerges[key] = append(n.remerges[key], done)
+	n.mu.Unlock()
+
+	if !n.work.enqueue(key) {
+		n.mu.Lock()
+		n.failRemerges(key, errStopped)
+		n.mu.Unlock()
+	} else {
+		klog.Infof("force merge secret %s", key)
+		n.sched.Schedule(key, util.Window{})
+	}
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// takeRemerges returns the waiting remerges of key and forgets them.
+func (n *manager) takeRemerges(key string) []chan error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	waiters := n.remerges[key]
+	delete(n.remerges, key)
+	return waiters
+}
+
+// failRemerges ends the waiting remerges of key with err, all keys if key is
+// empty. The caller holds the lock.
+func (n *manager) failRemerges(key string, err error) {
+	for k, waiters := range n.remerges {
+		if key != "" && k != key {
+			continue
+		}
+		for _, w := range waiters {
+			w <- err
+		}
+		delete(n.remerges, k)
+	}
+}
+
+// Pause stops merging the primary on triggers until Resume.
+func (n *manager) Pause(key string) error {
+	return n.setPaused(key, true)
+}
+
+// Resume merges the primary on triggers again, and merges it once.
+func (n *manager) Resume(key string) error {
+	if err := n.setPaused(key, false); err != nil {
+		return err
+	}
+	n.push(key)
+	return nil
+}
+
+func (n *manager) setPaused(key string, paused bool) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	v, ok := n.data[key]
+	if !ok {
+		return ErrPrimaryNotFound
+	}
+	v.paused = paused
+	klog.Infof("set secret %s paused %v", key, paused)
+	return nil
+}
+
+func (n *manager) isPaused(key string) bool {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	v, ok := n.data[key]
+	return ok && v.paused
+}
@@ -0,0 +1,159 @@
+// Copyright 2023 Authors of kmerge
+// SPDX-License-Identifier: Apache-2.0
+
+package resource
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/emirpasic/gods/sets/hashset"
+	"github.com/stretchr/testify/assert"
+	"github.com/yylt/kmerge/pkg"
+	"github.com/yylt/kmerge/pkg/util"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/client-go/util/workqueue"
+	"k8s.io/utils/lru"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func newTestManager(objs ...client.Object) *manager {
+	cli := fake.NewClientBuilder().
+		WithObjects(objs...).
+		WithIndex(&corev1.Secret{}, nameIndex, indexName).
+		WithIndex(&corev1.Secret{}, nsIndex, indexNamespace).
+		Build()
+	n := &manager{
+		ctx:      context.Background(),
+		Client:   cli,
+		data:     map[string]*res{},
+		remerges: map[string][]chan error{},
+		queue:    workqueue.New(),
+		work:     newWork(),
+		reader:   cli,
+		cache:    cli,
+		retry:    newRetry(time.Millisecond, time.Millisecond, 2),
+		deps:     newDepIndex(),
+		secrets:  lru.New(defaultSecretCacheSize),
+		recorder: record.NewFakeRecorder(16),
+	}
+	n.sched, _ = util.NewScheduler(util.SchedulerParameters{
+		MinInterval: time.Millisecond,
+		Workers:     minWorkNumber,
+		Func:        n.run,
+	})
+	return n
+}
+
+func newTestSecret(ns, name string, annotations map[string]string, data map[string]string) *corev1.Secret {
+	se := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace:   ns,
+			Name:        name,
+			Annotations: annotations,
+		},
+		Data: map[string][]byte{},
+	}
+	for k, v := range data {
+		se.Data[k] = []byte(v)
+	}
+	return se
+}
+
+func TestAdmin(t *testing.T) {
+	n := newTestManager(
+		newTestSecret("a", "src", map[string]string{pkg.KmergeNameKey: "group"}, nil),
+		newTestSecret("b", "src", map[string]string{pkg.KmergeNameKey: "group"}, nil),
+		newTestSecret("c", "src", map[string]string{pkg.KmergeNameKey: "other"}, nil),
+	)
+	n.data["p/primary"] = &res{
+		scheduled: true,
+		k:         pkg.Jsonk,
+		primary:   "p/primary",
+		name:      "group",
+		fromns:    hashset.New("b", "a"),
+	}
+
+	list := n.Primaries()
+	assert.Len(t, list, 1)
+	assert.Equal(t, PrimaryStatus{
+		Primary:        "p/primary",
+		Name:           "group",
+		Kind:           pkg.Jsonk,
+		FromNamespaces: []string{"a", "b"},
+		State:          StateIdle,
+	}, list[0])
+
+	sources, err := n.Sources("p/primary")
+	assert.NoError(t, err)
+	assert.Len(t, sources, 2)
+	assert.Equal(t, "a/src", sources[0].Source)
+	assert.Equal(t, "b/src", sources[1].Source)
+
+	_, err = n.Sources("p/none")
+	assert.ErrorIs(t, err, ErrPrimaryNotFound)
+
+	assert.NoError(t, n.Pause("p/primary"))
+	assert.Equal(t, StatePaused, n.Primaries()[0].State)
+	assert.NoError(t, n.Resume("p/primary"))
+	assert.Equal(t, StateIdle, n.Primaries()[0].State)
+	assert.Equal(t, []string{"p/primary"}, drainQueue(n))
+	assert.ErrorIs(t, n.Pause("p/none"), ErrPrimaryNotFound)
+}
+
+func TestSourcesWatchNamespaces(t *testing.T) {
+	n := newTestManager(
+		newTestSecret("a", "src", map[string]string{pkg.KmergeNameKey: "group"}, nil),
+		newTestSecret("b", "src", map[string]string{pkg.KmergeNameKey: "group"}, nil),
+	)
+	WithNamespaces("a", "p")(n)
+	n.data["p/primary"] = &res{
+		primary: "p/primary",
+		name:    "group",
+		fromns:  hashset.New("b", "a"),
+	}
+
+	sources, err := n.Sources("p/primary")
+	assert.NoError(t, err)
+	assert.Len(t, sources, 1)
+	assert.Equal(t, "a/src", sources[0].Source)
+}
+
+func TestRemerge(t *testing.T) {
+	annotations := map[string]string{
+		pkg.KmergePrimaryKey: "",
+		pkg.KmergeNameKey:    "group",
+	}
+	n := newTestManager(
+		newTestSecret("p", "primary", annotations, map[string]string{"k": "old"}),
+		newTestSecret("a", "src", map[string]string{pkg.KmergeNameKey: "group"}, map[string]string{"k": "new"}),
+	)
+	info := newRes("p/primary")
+	info.parse(annotations)
+	info.scheduled = true
+	info.paused = true
+	n.data["p/primary"] = info
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	// paused primaries are merged as well
+	assert.NoError(t, n.Remerge(ctx, "p/primary"))
+	got := &corev1.Secret{}
+	assert.NoError(t, n.Get(ctx, types.NamespacedName{Namespace: "p", Name: "primary"}, got))
+	assert.Equal(t, "new", string(got.Data["k"]))
+	assert.Equal(t, StatePaused, n.Primaries()[0].State)
+
+	assert.ErrorIs(t, n.Remerge(ctx, "p/none"), ErrPrimaryNotFound)
+
+	info.scheduled = false
+	assert.ErrorIs(t, n.Remerge(ctx, "p/primary"), ErrPrimaryNotOwned)
+	info.scheduled = true
+
+	n.Drain(ctx)
+	assert.ErrorIs(t, n.Remerge(ctx, "p/primary"), errStopped)
+}
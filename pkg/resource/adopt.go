@@ -0,0 +1,64 @@
+// Copyright 2023 Authors of kmerge
+// SPDX-License-Identifier: Apache-2.0
+
+package resource
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/util/csaupgrade"
+	"k8s.io/klog/v2"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// legacyFieldManager is the manager of the updates kmerge made before it
+// applied, the apiserver names it after the user agent.
+var legacyFieldManager = strings.Split(rest.DefaultKubernetesUserAgent(), "/")[0]
+
+// adoptFields migrates the fields kmerge wrote by Update before it applied
+// to FieldManager, so the first apply does not conflict with kmerge itself.
+// It is a no-op once migrated. Fields of other managers are left alone and
+// conflict on apply.
+func (m *manager) adoptFields(in *corev1.Secret) error {
+	entries, err := adoptedEntries(in.ManagedFields)
+	if err != nil || entries == nil {
+		return err
+	}
+	patch, err := json.Marshal([]map[string]any{
+		{"op": "replace", "path": "/metadata/managedFields", "value": entries},
+		// rejected if in is stale
+		{"op": "replace", "path": "/metadata/resourceVersion", "value": in.ResourceVersion},
+	})
+	if err != nil {
+		return err
+	}
+	klog.Infof("migrate fields of secret %s/%s written by %s", in.Namespace, in.Name, legacyFieldManager)
+	return m.Client.Patch(m.ctx, in.DeepCopy(), client.RawPatch(types.JSONPatchType, patch))
+}
+
+// adoptedEntries returns the managed fields with the entries of the legacy
+// manager merged into the apply entry of FieldManager, or nil if there are
+// none.
+func adoptedEntries(managed []metav1.ManagedFieldsEntry) ([]metav1.ManagedFieldsEntry, error) {
+	if len(managed) == 0 {
+		return nil, nil
+	}
+	upgraded := &metav1.PartialObjectMetadata{ObjectMeta: metav1.ObjectMeta{
+		ManagedFields: append([]metav1.ManagedFieldsEntry(nil), managed...),
+	}}
+	err := csaupgrade.UpgradeManagedFields(upgraded, sets.New(legacyFieldManager), FieldManager)
+	if err != nil {
+		return nil, err
+	}
+	if reflect.DeepEqual(upgraded.ManagedFields, managed) {
+		return nil, nil
+	}
+	return upgraded.ManagedFields, nil
+}
@@ -0,0 +1,99 @@
+// Copyright 2023 Authors of kmerge
+// SPDX-License-Identifier: Apache-2.0
+
+package resource
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/yylt/kmerge/pkg"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+func managedEntry(manager string, op metav1.ManagedFieldsOperationType, fields string) metav1.ManagedFieldsEntry {
+	return metav1.ManagedFieldsEntry{
+		Manager:    manager,
+		Operation:  op,
+		APIVersion: "v1",
+		FieldsType: "FieldsV1",
+		FieldsV1:   &metav1.FieldsV1{Raw: []byte(fields)},
+	}
+}
+
+func findEntry(entries []metav1.ManagedFieldsEntry, manager string) *metav1.ManagedFieldsEntry {
+	for i := range entries {
+		if entries[i].Manager == manager {
+			return &entries[i]
+		}
+	}
+	return nil
+}
+
+func TestAdoptedEntries(t *testing.T) {
+	managed := []metav1.ManagedFieldsEntry{
+		managedEntry(legacyFieldManager, metav1.ManagedFieldsOperationUpdate,
+			`{"f:data":{"f:k":{}},"f:metadata":{"f:annotations":{"f:kmerge.io/hash":{}}}}`),
+		managedEntry("kubectl-create", metav1.ManagedFieldsOperationUpdate,
+			`{"f:data":{".":{},"f:k":{},"f:o":{}},"f:metadata":{"f:annotations":{".":{},"f:kmerge.io/name":{}}},"f:type":{}}`),
+		managedEntry("other", metav1.ManagedFieldsOperationApply, `{"f:data":{"f:o":{}}}`),
+	}
+
+	entries, err := adoptedEntries(managed)
+	assert.NoError(t, err)
+	assert.Len(t, entries, 3)
+	assert.Nil(t, findEntry(entries, legacyFieldManager))
+
+	kmerge := findEntry(entries, FieldManager)
+	assert.NotNil(t, kmerge)
+	assert.Equal(t, metav1.ManagedFieldsOperationApply, kmerge.Operation)
+	assert.JSONEq(t, `{"f:data":{"f:k":{}},"f:metadata":{"f:annotations":{"f:kmerge.io/hash":{}}}}`, string(kmerge.FieldsV1.Raw))
+
+	// fields of other managers are kept, and conflict on apply
+	assert.Equal(t, managed[1], *findEntry(entries, "kubectl-create"))
+	assert.Equal(t, managed[2], *findEntry(entries, "other"))
+
+	// migrated once
+	entries, err = adoptedEntries(entries)
+	assert.NoError(t, err)
+	assert.Nil(t, entries)
+
+	// nothing to migrate without the legacy manager
+	entries, err = adoptedEntries(managed[1:])
+	assert.NoError(t, err)
+	assert.Nil(t, entries)
+}
+
+func TestHandleAdoptFields(t *testing.T) {
+	annotations := map[string]string{
+		pkg.KmergePrimaryKey: "",
+		pkg.KmergeNameKey:    "group",
+	}
+	primary := newTestSecret("p", "primary", annotations, map[string]string{"k": "old"})
+	primary.ManagedFields = []metav1.ManagedFieldsEntry{
+		managedEntry(legacyFieldManager, metav1.ManagedFieldsOperationUpdate,
+			`{"f:data":{"f:k":{}},"f:metadata":{"f:annotations":{"f:kmerge.io/hash":{}}}}`),
+		managedEntry("kubectl-edit", metav1.ManagedFieldsOperationUpdate, `{"f:data":{"f:o":{}}}`),
+	}
+	n := newTestManager(
+		primary,
+		newTestSecret("a", "src", map[string]string{pkg.KmergeNameKey: "group"}, map[string]string{"k": "new"}),
+	)
+	info := newRes("p/primary")
+	info.parse(annotations)
+	n.data["p/primary"] = info
+
+	assert.NoError(t, n.handle("p/primary"))
+
+	got := &corev1.Secret{}
+	assert.NoError(t, n.Get(n.ctx, types.NamespacedName{Namespace: "p", Name: "primary"}, got))
+	assert.Equal(t, "new", string(got.Data["k"]))
+	assert.Nil(t, findEntry(got.ManagedFields, legacyFieldManager))
+	kmerge := findEntry(got.ManagedFields, FieldManager)
+	if assert.NotNil(t, kmerge) {
+		assert.Equal(t, metav1.ManagedFieldsOperationApply, kmerge.Operation)
+	}
+	assert.Equal(t, primary.ManagedFields[1], *findEntry(got.ManagedFields, "kubectl-edit"))
+}
@@ -0,0 +1,137 @@
+// Copyright 2023 Authors of kmerge
+// SPDX-License-Identifier: Apache-2.0
+
+package resource
+
+import (
+	"context"
+	"sort"
+	"sync"
+
+	"github.com/yylt/kmerge/pkg/lock"
+	"k8s.io/klog/v2"
+)
+
+// DrainReport lists the primaries which were not merged when draining ends.
+type DrainReport struct {
+	// Running merges did not finish before the deadline.
+	Running []string `json:"running,omitempty"`
+
+	// Queued merges were triggered but refused by draining.
+	Queued []string `json:"queued,omitempty"`
+}
+
+// work tracks the merges waiting in triggers and the running ones.
+type work struct {
+	mu sync.Mutex
+
+	stopped bool
+	queued  map[string]struct{}
+	running map[string]int
+
+	// wg counts the running merges, Add is a no-op once stopped
+	wg *lock.StoppableWaitGroup
+}
+
+func newWork() *work {
+	return &work{
+		queued:  map[string]struct{}{},
+		running: map[string]int{},
+		wg:      lock.NewStoppableWaitGroup(),
+	}
+}
+
+// enqueue records key is triggered, it returns false after stop.
+func (w *work) enqueue(key string) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.stopped {
+		return false
+	}
+	w.queued[key] = struct{}{}
+	return true
+}
+
+// begin marks a merge of key is running, it returns false after stop.
+func (w *work) begin(key string) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.stopped {
+		return false
+	}
+	delete(w.queued, key)
+	w.running[key]++
+	w.wg.Add()
+	return true
+}
+
+func (w *work) end(key string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.running[key]--
+	if w.running[key] <= 0 {
+		delete(w.running, key)
+	}
+	w.wg.Done()
+}
+
+// state returns the merge state of key.
+func (w *work) state(key string) string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	switch {
+	case w.running[key] > 0:
+		return StateRunning
+	case w.stopped:
+		return StateStopped
+	}
+	if _, ok := w.queued[key]; ok {
+		return StateQueued
+	}
+	return StateIdle
+}
+
+// stop refuses new merges and waits the running ones until ctx is done.
+func (w *work) stop(ctx context.Context) DrainReport {
+	w.mu.Lock()
+	w.stopped = true
+	w.mu.Unlock()
+	w.wg.Stop()
+
+	select {
+	case <-w.wg.WaitChannel():
+	case <-ctx.Done():
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	report := DrainReport{}
+	for k := range w.running {
+		report.Running = append(report.Running, k)
+	}
+	for k := range w.queued {
+		report.Queued = append(report.Queued, k)
+	}
+	sort.Strings(report.Running)
+	sort.Strings(report.Queued)
+	return report
+}
+
+// Drain stops accepting new merges and waits for the running merges and
+// patches to finish until ctx is done. The primaries which were not merged
+// are reported.
+func (n *manager) Drain(ctx context.Context) DrainReport {
+	n.sched.Shutdown()
+	// the pending remerges never run
+	n.mu.Lock()
+	n.failRemerges("", errStopped)
+	n.mu.Unlock()
+
+	report := n.work.stop(ctx)
+	if abandoned := len(report.Running) + len(report.Queued); abandoned > 0 {
+		klog.Warningf("drain secret manager, %d merges abandoned, running %v, queued %v", abandoned, report.Running, report.Queued)
+	} else {
+		klog.Info("drain secret manager, all merges finished")
+	}
+	return report
+}
@@ -0,0 +1,42 @@
+// Copyright 2023 Authors of kmerge
+// SPDX-License-Identifier: Apache-2.0
+
+package resource
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWorkStop(t *testing.T) {
+	w := newWork()
+	assert.True(t, w.enqueue("ns/a"))
+	assert.True(t, w.enqueue("ns/b"))
+	assert.True(t, w.begin("ns/a"))
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		w.end("ns/a")
+	}()
+	report := w.stop(context.Background())
+	assert.Empty(t, report.Running)
+	assert.Equal(t, []string{"ns/b"}, report.Queued)
+
+	// refused after stop
+	assert.False(t, w.enqueue("ns/c"))
+	assert.False(t, w.begin("ns/b"))
+}
+
+func TestWorkStopTimeout(t *testing.T) {
+	w := newWork()
+	assert.True(t, w.begin("ns/a"))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	report := w.stop(ctx)
+	assert.Equal(t, []string{"ns/a"}, report.Running)
+	assert.Empty(t, report.Queued)
+}
@@ -0,0 +1,173 @@
+// Copyright 2023 Authors of kmerge
+// SPDX-License-Identifier: Apache-2.0
+
+package resource
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/yylt/kmerge/pkg"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// Provenance tells which sources supplied the merged value of a key, or of a
+// leaf path inside a json/yaml key.
+type Provenance struct {
+	Key string `json:"key"`
+
+	// Path is the dot separated leaf path, empty for text keys.
+	Path string `json:"path,omitempty"`
+
+	// Sources supplied the merged value, text values are concatenated from all
+	// of them, a leaf takes the value of the last source setting it.
+	Sources []string `json:"sources,omitempty"`
+
+	// Overridden sources set the leaf, but lost to Sources.
+	Overridden []string `json:"overridden,omitempty"`
+
+	// Value is the merged value, json encoded for leaves.
+	Value string `json:"value"`
+}
+
+// Explanation is the merge of one primary with per key provenance.
+type Explanation struct {
+	Primary string   `json:"primary"`
+	Kind    pkg.Kind `json:"kind"`
+
+	// Sources are namespace/name of the merged secrets, in merge order.
+	Sources []string `json:"sources"`
+
+	Keys []Provenance `json:"keys"`
+}
+
+// Explain recomputes the merge of primary with the sources found in secrets,
+// and tells which source supplied every key and leaf.
+func Explain(primary *corev1.Secret, secrets []corev1.Secret) (*Explanation, error) {
+	if !isPrimary(primary.Annotations) {
+		return nil, fmt.Errorf("%s/%s is not a primary", primary.Namespace, primary.Name)
+	}
+	se := newRes(fmt.Sprintf("%s/%s", primary.Namespace, primary.Name))
+	se.parse(primary.Annotations)
+	infos := selectSources(&corev1.SecretList{Items: secrets}, se)
+	if se.skipInvalid {
+		infos, _ = validSources(infos, primary, se.k)
+	}
+
+	ex := &Explanation{
+		Primary: se.primary,
+		Kind:    se.k,
+	}
+	for _, v := range infos {
+		ex.Sources = append(ex.Sources, fmt.Sprintf("%s/%s", v.Namespace, v.Name))
+	}
+	out, _, err := render(infos, primary, se)
+	if err != nil {
+		return nil, err
+	}
+
+	var keys []string
+	for k := range out.Data {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		var (
+			names  []string
+			values [][]byte
+		)
+		for i, v := range infos {
+			if d, ok := v.Data[k]; ok {
+				names = append(names, ex.Sources[i])
+				values = append(values, d)
+			}
+		}
+		if se.k == pkg.Textk {
+			ex.Keys = append(ex.Keys, Provenance{
+				Key:     k,
+				Sources: names,
+				Value:   string(out.Data[k]),
+			})
+			continue
+		}
+		leaves, err := explainLeaves(se.k, k, out.Data[k], names, values)
+		if err != nil {
+			return nil, err
+		}
+		ex.Keys = append(ex.Keys, leaves...)
+	}
+	return ex, nil
+}
+
+// explainLeaves compares every leaf of the merged value with the sources, the
+// winner is the last source holding the merged value.
+func explainLeaves(kind pkg.Kind, key string, merged []byte, names []string, values [][]byte) ([]Provenance, error) {
+	result := map[string]any{}
+	if err := kind.Unmarshal(merged, &result); err != nil {
+		return nil, err
+	}
+	sources := make([]map[string]any, len(values))
+	for i, v := range values {
+		src := map[string]any{}
+		if err := kind.Unmarshal(v, &src); err != nil {
+			return nil, fmt.Errorf("source %s key %s: %v", names[i], key, err)
+		}
+		sources[i] = flatten(src, "", map[string]any{})
+	}
+
+	var (
+		leaves = flatten(result, "", map[string]any{})
+		paths  []string
+		list   []Provenance
+	)
+	for p := range leaves {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+	for _, p := range paths {
+		pv := Provenance{Key: key, Path: p}
+		winner := -1
+		for i := len(sources) - 1; i >= 0; i-- {
+			if v, ok := sources[i][p]; ok && reflect.DeepEqual(v, leaves[p]) {
+				winner = i
+				break
+			}
+		}
+		for i := range sources {
+			if _, ok := sources[i][p]; !ok {
+				continue
+			}
+			if i == winner {
+				pv.Sources = []string{names[i]}
+			} else {
+				pv.Overridden = append(pv.Overridden, names[i])
+			}
+		}
+		value, err := json.Marshal(leaves[p])
+		if err != nil {
+			return nil, err
+		}
+		pv.Value = string(value)
+		list = append(list, pv)
+	}
+	return list, nil
+}
+
+// flatten records the leaves of m by dot separated path, lists are leaves.
+func flatten(m map[string]any, prefix string, out map[string]any) map[string]any {
+	for k, v := range m {
+		p := k
+		if prefix != "" {
+			p = strings.Join([]string{prefix, k}, ".")
+		}
+		if sub, ok := v.(map[string]any); ok && len(sub) > 0 {
+			flatten(sub, p, out)
+			continue
+		}
+		out[p] = v
+	}
+	return out
+}
@@ -0,0 +1,47 @@
+// Copyright 2023 Authors of kmerge
+// SPDX-License-Identifier: Apache-2.0
+
+package resource
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/yylt/kmerge/pkg"
+	corev1 "k8s.io/api/core/v1"
+)
+
+func TestExplain(t *testing.T) {
+	source := map[string]string{pkg.KmergeNameKey: "group"}
+	primary := newTestSecret("p", "primary", map[string]string{
+		pkg.KmergePrimaryKey: "",
+		pkg.KmergeNameKey:    "group",
+		pkg.KmergeTypeKey:    "yaml",
+	}, map[string]string{"k": ""})
+
+	ex, err := Explain(primary, []corev1.Secret{
+		*newTestSecret("a", "src", source, map[string]string{"k": "a: 1\nb:\n  c: 1\n"}),
+		*newTestSecret("b", "src", source, map[string]string{"k": "a: 2\nb:\n  d: 1\n"}),
+		*newTestSecret("c", "src", source, map[string]string{"k": "a: 2\n"}),
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"a/src", "b/src", "c/src"}, ex.Sources)
+	assert.Equal(t, []Provenance{
+		{Key: "k", Path: "a", Sources: []string{"c/src"}, Overridden: []string{"a/src", "b/src"}, Value: "2"},
+		{Key: "k", Path: "b.c", Sources: []string{"a/src"}, Value: "1"},
+		{Key: "k", Path: "b.d", Sources: []string{"b/src"}, Value: "1"},
+	}, ex.Keys)
+
+	primary.Annotations[pkg.KmergeTypeKey] = "text"
+	ex, err = Explain(primary, []corev1.Secret{
+		*newTestSecret("a", "src", source, map[string]string{"k": "x"}),
+		*newTestSecret("b", "src", source, map[string]string{"k": "y"}),
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []Provenance{
+		{Key: "k", Sources: []string{"a/src", "b/src"}, Value: "xy"},
+	}, ex.Keys)
+
+	_, err = Explain(newTestSecret("p", "none", nil, nil), nil)
+	assert.Error(t, err)
+}
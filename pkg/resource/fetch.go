@@ -0,0 +1,56 @@
+// Copyright 2023 Authors of kmerge
+// SPDX-License-Identifier: Apache-2.0
+
+package resource
+
+import (
+	"context"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// defaultSecretCacheSize is the number of full secrets kept for merges.
+const defaultSecretCacheSize = 256
+
+// secretVersion is a secret at a resourceVersion.
+type secretVersion struct {
+	types.NamespacedName
+	resourceVersion string
+}
+
+// SecretMeta returns the metadata of a secret, which is what the cache keeps
+// for secrets.
+func SecretMeta() *metav1.PartialObjectMetadata {
+	meta := &metav1.PartialObjectMetadata{}
+	meta.SetGroupVersionKind(corev1.SchemeGroupVersion.WithKind("Secret"))
+	return meta
+}
+
+func newSecretMetaList() *metav1.PartialObjectMetadataList {
+	list := &metav1.PartialObjectMetadataList{}
+	list.SetGroupVersionKind(corev1.SchemeGroupVersion.WithKind("SecretList"))
+	return list
+}
+
+// fetch returns the full secret of meta. It is read from apiserver unless
+// the resourceVersion of meta is kept.
+func (n *manager) fetch(ctx context.Context, meta client.Object) (*corev1.Secret, error) {
+	key := secretVersion{
+		NamespacedName:  client.ObjectKeyFromObject(meta),
+		resourceVersion: meta.GetResourceVersion(),
+	}
+	if v, ok := n.secrets.Get(key); ok {
+		return v.(*corev1.Secret).DeepCopy(), nil
+	}
+	se := &corev1.Secret{}
+	if err := n.reader.Get(ctx, key.NamespacedName, se); err != nil {
+		return nil, err
+	}
+	// the cache may lag behind apiserver
+	key.resourceVersion = se.ResourceVersion
+	n.secrets.Add(key, se.DeepCopy())
+	return se, nil
+}
@@ -0,0 +1,55 @@
+// Copyright 2023 Authors of kmerge
+// SPDX-License-Identifier: Apache-2.0
+
+package resource
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/yylt/kmerge/pkg"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// countReader counts the reads from apiserver.
+type countReader struct {
+	client.Reader
+	gets int
+}
+
+func (r *countReader) Get(ctx context.Context, key client.ObjectKey, obj client.Object, opts ...client.GetOption) error {
+	r.gets++
+	return r.Reader.Get(ctx, key, obj, opts...)
+}
+
+func TestFetch(t *testing.T) {
+	n := newTestManager(newTestSecret("a", "src", map[string]string{pkg.KmergeNameKey: "group"}, map[string]string{"k": "v"}))
+	reader := &countReader{Reader: n.reader}
+	n.reader = reader
+
+	key := types.NamespacedName{Namespace: "a", Name: "src"}
+	meta := SecretMeta()
+	assert.NoError(t, n.Get(n.ctx, key, meta))
+
+	se, err := n.fetch(n.ctx, meta)
+	assert.NoError(t, err)
+	assert.Equal(t, "v", string(se.Data["k"]))
+
+	// kept by resourceVersion, and copied
+	se.Data["k"] = []byte("changed")
+	se, err = n.fetch(n.ctx, meta)
+	assert.NoError(t, err)
+	assert.Equal(t, "v", string(se.Data["k"]))
+	assert.Equal(t, 1, reader.gets)
+
+	// a new resourceVersion is read again
+	se.Data["k"] = []byte("new")
+	assert.NoError(t, n.Update(n.ctx, se))
+	assert.NoError(t, n.Get(n.ctx, key, meta))
+	se, err = n.fetch(n.ctx, meta)
+	assert.NoError(t, err)
+	assert.Equal(t, "new", string(se.Data["k"]))
+	assert.Equal(t, 2, reader.gets)
+}
@@ -0,0 +1,121 @@
+// Copyright 2023 Authors of kmerge
+// SPDX-License-Identifier: Apache-2.0
+
+package resource
+
+import (
+	"github.com/yylt/kmerge/pkg"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const (
+	// nameIndex indexes secrets by the kmerge.io/name annotation.
+	nameIndex = "metadata.annotations." + pkg.KmergeNameKey
+
+	// nsIndex indexes the secrets with the kmerge.io/name annotation by
+	// namespace, to list the sources of primaries merging from namespaces.
+	nsIndex = "metadata.namespace"
+)
+
+func indexName(obj client.Object) []string {
+	name, ok := obj.GetAnnotations()[pkg.KmergeNameKey]
+	if !ok || name == "" {
+		return nil
+	}
+	return []string{name}
+}
+
+func indexNamespace(obj client.Object) []string {
+	if indexName(obj) == nil {
+		return nil
+	}
+	return []string{obj.GetNamespace()}
+}
+
+// depIndex maps source secrets to the primaries merging them. It is guarded
+// by the manager lock.
+type depIndex struct {
+	// group name -> primaries merging from all namespaces
+	all map[string]sets.Set[string]
+
+	// group name and namespace -> primaries merging from the namespace
+	byNs map[depKey]sets.Set[string]
+
+	// source namespace/name -> group name, to find the primaries of a
+	// source which is gone
+	sources map[string]string
+}
+
+type depKey struct {
+	name string
+	ns   string
+}
+
+func newDepIndex() *depIndex {
+	return &depIndex{
+		all:     map[string]sets.Set[string]{},
+		byNs:    map[depKey]sets.Set[string]{},
+		sources: map[string]string{},
+	}
+}
+
+func (d *depIndex) addPrimary(r *res) {
+	if r.fromns == nil || r.fromns.Size() == 0 {
+		addDep(d.all, r.name, r.primary)
+		return
+	}
+	for _, v := range r.fromns.Values() {
+		addDep(d.byNs, depKey{name: r.name, ns: v.(string)}, r.primary)
+	}
+}
+
+func (d *depIndex) removePrimary(r *res) {
+	if r.fromns == nil || r.fromns.Size() == 0 {
+		removeDep(d.all, r.name, r.primary)
+		return
+	}
+	for _, v := range r.fromns.Values() {
+		removeDep(d.byNs, depKey{name: r.name, ns: v.(string)}, r.primary)
+	}
+}
+
+// setSource records the group name of a source, and returns the previous one.
+func (d *depIndex) setSource(nsname, name string) string {
+	old := d.sources[nsname]
+	if name == "" {
+		delete(d.sources, nsname)
+	} else {
+		d.sources[nsname] = name
+	}
+	return old
+}
+
+// primaries returns the primaries merging the sources of group name in ns.
+func (d *depIndex) primaries(name, ns string) []string {
+	if name == "" {
+		return nil
+	}
+	list := d.all[name].UnsortedList()
+	return append(list, d.byNs[depKey{name: name, ns: ns}].UnsortedList()...)
+}
+
+func addDep[K comparable](m map[K]sets.Set[string], k K, primary string) {
+	s, ok := m[k]
+	if !ok {
+		s = sets.New[string]()
+		m[k] = s
+	}
+	s.Insert(primary)
+}
+
+func removeDep[K comparable](m map[K]sets.Set[string], k K, primary string) {
+	s, ok := m[k]
+	if !ok {
+		return
+	}
+	s.Delete(primary)
+	if s.Len() == 0 {
+		delete(m, k)
+	}
+}
@@ -0,0 +1,108 @@
+// Copyright 2023 Authors of kmerge
+// SPDX-License-Identifier: Apache-2.0
+
+package resource
+
+import (
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/yylt/kmerge/pkg"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+)
+
+func drainQueue(n *manager) []string {
+	var keys []string
+	for n.queue.Len() > 0 {
+		item, _ := n.queue.Get()
+		keys = append(keys, item.(string))
+		n.queue.Done(item)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func reconcile(t *testing.T, n *manager, ns, name string) []string {
+	_, err := n.Reconcile(n.ctx, ctrl.Request{NamespacedName: types.NamespacedName{Namespace: ns, Name: name}})
+	assert.NoError(t, err)
+	return drainQueue(n)
+}
+
+func TestReverseIndex(t *testing.T) {
+	primary := func(name, from string) map[string]string {
+		a := map[string]string{pkg.KmergePrimaryKey: "", pkg.KmergeNameKey: name}
+		if from != "" {
+			a[pkg.KmergeFromNsKey] = from
+		}
+		return a
+	}
+	src := newTestSecret("a", "src", map[string]string{pkg.KmergeNameKey: "group"}, nil)
+	n := newTestManager(
+		newTestSecret("p", "all", primary("group", ""), nil),
+		newTestSecret("p", "froma", primary("group", "a"), nil),
+		newTestSecret("p", "fromb", primary("group", "b"), nil),
+		newTestSecret("p", "other", primary("other", ""), nil),
+		src,
+	)
+	for _, name := range []string{"all", "froma", "fromb", "other"} {
+		assert.Equal(t, []string{"p/" + name}, reconcile(t, n, "p", name))
+	}
+	defer n.sched.Shutdown()
+
+	assert.Equal(t, []string{"p/all", "p/froma"}, reconcile(t, n, "a", "src"))
+
+	// moved to another group, both groups are merged
+	src.Annotations[pkg.KmergeNameKey] = "other"
+	assert.NoError(t, n.Update(n.ctx, src))
+	assert.Equal(t, []string{"p/all", "p/froma", "p/other"}, reconcile(t, n, "a", "src"))
+
+	// deleted, the last known group is merged
+	assert.NoError(t, n.Delete(n.ctx, src))
+	assert.Equal(t, []string{"p/other"}, reconcile(t, n, "a", "src"))
+
+	// primary changed to merge from namespace a only
+	all := &corev1.Secret{}
+	assert.NoError(t, n.Get(n.ctx, types.NamespacedName{Namespace: "p", Name: "all"}, all))
+	all.Annotations[pkg.KmergeFromNsKey] = "a"
+	assert.NoError(t, n.Update(n.ctx, all))
+	assert.Equal(t, []string{"p/all"}, reconcile(t, n, "p", "all"))
+	assert.ElementsMatch(t, []string{"p/all", "p/froma"}, n.deps.primaries("group", "a"))
+	assert.Empty(t, n.deps.primaries("group", "c"))
+
+	// primary deleted
+	assert.NoError(t, n.Delete(n.ctx, all))
+	assert.Empty(t, reconcile(t, n, "p", "all"))
+	assert.Equal(t, []string{"p/froma"}, n.deps.primaries("group", "a"))
+}
+
+func TestSourcesIndex(t *testing.T) {
+	primary := map[string]string{pkg.KmergePrimaryKey: "", pkg.KmergeNameKey: "group", pkg.KmergeFromNsKey: "a"}
+	n := newTestManager(
+		newTestSecret("p", "primary", primary, nil),
+		newTestSecret("a", "src", map[string]string{pkg.KmergeNameKey: "group"}, nil),
+		newTestSecret("a", "other", map[string]string{pkg.KmergeNameKey: "other"}, nil),
+		newTestSecret("a", "plain", nil, nil),
+		newTestSecret("b", "src", map[string]string{pkg.KmergeNameKey: "group"}, nil),
+	)
+	assert.Nil(t, indexNamespace(newTestSecret("a", "plain", nil, nil)))
+
+	info := newRes("p/primary")
+	info.parse(primary)
+	infos, err := n.sources(info)
+	assert.NoError(t, err)
+	if assert.Len(t, infos, 1) {
+		assert.Equal(t, "a", infos[0].Namespace)
+		assert.Equal(t, "src", infos[0].Name)
+	}
+
+	// all namespaces
+	delete(primary, pkg.KmergeFromNsKey)
+	info = newRes("p/primary")
+	info.parse(primary)
+	infos, err = n.sources(info)
+	assert.NoError(t, err)
+	assert.Len(t, infos, 2)
+}
@@ -1,6 +1,7 @@
 package resource
 
 import (
+	"bytes"
 	"encoding/json"
 
 	"dario.cat/mergo"
@@ -23,57 +24,44 @@ func TextMerge(s [][]byte) ([]byte, error) {
 	for _, v := range s {
 		buf.Write(v)
 	}
-	return buf.Bytes(), nil
+	// the buffer goes back to pool
+	return bytes.Clone(buf.Bytes()), nil
 }
 
 func JsonMerge(s [][]byte) ([]byte, error) {
 	var (
-		data = make([]map[string]any, len(s))
-		err  error
-
-		tmp any
+		dst = map[string]any{}
+		err error
 	)
-	for i, v := range s {
-		data[i] = map[string]any{}
-		err = json.Unmarshal(v, data[i])
+	for _, v := range s {
+		src := map[string]any{}
+		err = json.Unmarshal(v, &src)
 		if err != nil {
 			return nil, err
 		}
-		if i == 0 {
-			tmp = data[i]
-		}
-	}
-	for i := 1; i < len(data); i++ {
-		err = mergo.Merge(tmp, data[i], mergeOpt...)
+		err = mergo.Merge(&dst, src, mergeOpt...)
 		if err != nil {
 			return nil, err
 		}
 	}
-	return json.Marshal(tmp)
+	return json.Marshal(dst)
 }
 
 func YamlMerge(s [][]byte) ([]byte, error) {
 	var (
-		data = make([]map[string]any, len(s))
-		err  error
-
-		tmp any
+		dst = map[string]any{}
+		err error
 	)
-	for i, v := range s {
-		data[i] = map[string]any{}
-		err = yaml.Unmarshal(v, data[i])
+	for _, v := range s {
+		src := map[string]any{}
+		err = yaml.Unmarshal(v, &src)
 		if err != nil {
 			return nil, err
 		}
-		if i == 0 {
-			tmp = data[i]
-		}
-	}
-	for i := 1; i < len(data); i++ {
-		err = mergo.Merge(tmp, data[i], mergeOpt...)
+		err = mergo.Merge(&dst, src, mergeOpt...)
 		if err != nil {
 			return nil, err
 		}
 	}
-	return yaml.Marshal(tmp)
+	return yaml.Marshal(dst)
 }
@@ -0,0 +1,41 @@
+// Copyright 2023 Authors of kmerge
+// SPDX-License-Identifier: Apache-2.0
+
+package resource
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTextMerge(t *testing.T) {
+	out, err := TextMerge([][]byte{[]byte("a\n"), []byte("b\n")})
+	assert.NoError(t, err)
+	assert.Equal(t, "a\nb\n", string(out))
+}
+
+func TestJsonMerge(t *testing.T) {
+	out, err := JsonMerge([][]byte{
+		[]byte(`{"a":1,"b":{"c":1}}`),
+		[]byte(`{"a":2,"b":{"d":1}}`),
+	})
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"a":2,"b":{"c":1,"d":1}}`, string(out))
+
+	out, err = JsonMerge(nil)
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{}`, string(out))
+
+	_, err = JsonMerge([][]byte{[]byte(`{"a":`)})
+	assert.Error(t, err)
+}
+
+func TestYamlMerge(t *testing.T) {
+	out, err := YamlMerge([][]byte{
+		[]byte("a: 1\nb:\n  c: 1\n"),
+		[]byte("b:\n  d: 1\n"),
+	})
+	assert.NoError(t, err)
+	assert.YAMLEq(t, "a: 1\nb:\n  c: 1\n  d: 1\n", string(out))
+}
@@ -0,0 +1,60 @@
+// Copyright 2023 Authors of kmerge
+// SPDX-License-Identifier: Apache-2.0
+
+package resource
+
+import (
+	"fmt"
+
+	"github.com/yylt/kmerge/pkg/notify"
+)
+
+// Notifier is told the result of every merge, Notify must not block.
+type Notifier interface {
+	Notify(ev notify.Event)
+}
+
+// WithNotifier notifies the results of merges to nf.
+func WithNotifier(nf Notifier) Option {
+	return func(n *manager) {
+		n.notifier = nf
+	}
+}
+
+// written is the hash of the written secret before and after a merge, which
+// is the primary, or the preview secret in dry-run mode.
+type written struct {
+	old string
+	sum string
+
+	// the secret was patched
+	changed bool
+}
+
+// notify tells the notifier the result of a merge of the primary key.
+func (n *manager) notify(key string, se *res, infos seInfos, w written, err error) {
+	if n.notifier == nil {
+		return
+	}
+	ev := notify.Event{
+		Primary: key,
+		Sources: []string{},
+		Result:  notify.Unchanged,
+		OldHash: w.old,
+		NewHash: w.sum,
+	}
+	if se != nil {
+		ev.DryRun = se.dryRun
+	}
+	for _, v := range infos {
+		ev.Sources = append(ev.Sources, fmt.Sprintf("%s/%s", v.Namespace, v.Name))
+	}
+	switch {
+	case err != nil:
+		ev.Result = notify.Failed
+		ev.Error = err.Error()
+	case w.changed:
+		ev.Result = notify.Changed
+	}
+	n.notifier.Notify(ev)
+}
@@ -0,0 +1,117 @@
+// Copyright 2023 Authors of kmerge
+// SPDX-License-Identifier: Apache-2.0
+
+package resource
+
+import (
+	"reflect"
+	"strings"
+
+	"github.com/yylt/kmerge/pkg"
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+)
+
+// statusAnnotations are written by kmerge, and do not change the merge.
+var statusAnnotations = []string{pkg.KmergeHashKey, pkg.KmergeSkippedKey}
+
+func isStatusAnnotation(k string) bool {
+	for _, v := range statusAnnotations {
+		if k == v {
+			return true
+		}
+	}
+	return false
+}
+
+func isKmergeKey(k string) bool {
+	return strings.HasPrefix(k, "kmerge.io/") || strings.Contains(k, ".kmerge.io/")
+}
+
+// relevant returns whether obj has kmerge annotations or labels, other than
+// the status annotations.
+func relevant(obj client.Object) bool {
+	if obj == nil {
+		return false
+	}
+	for k := range obj.GetAnnotations() {
+		if isKmergeKey(k) && !isStatusAnnotation(k) {
+			return true
+		}
+	}
+	for k := range obj.GetLabels() {
+		if isKmergeKey(k) {
+			return true
+		}
+	}
+	return false
+}
+
+// statusOnly returns whether the update only changed status annotations or
+// managed fields. The data changed together with the hash is written by
+// kmerge as well. The data
+// of metadata objects is unknown, so their updates are status only if the
+// hash changed.
+func statusOnly(oldObj, newObj client.Object) bool {
+	if sameObject(oldObj, newObj) {
+		return true
+	}
+	if !reflect.DeepEqual(oldObj.GetLabels(), newObj.GetLabels()) {
+		return false
+	}
+	oldAnno, newAnno := oldObj.GetAnnotations(), newObj.GetAnnotations()
+	for k, v := range newAnno {
+		if ov, ok := oldAnno[k]; !isStatusAnnotation(k) && (!ok || ov != v) {
+			return false
+		}
+	}
+	for k := range oldAnno {
+		if _, ok := newAnno[k]; !isStatusAnnotation(k) && !ok {
+			return false
+		}
+	}
+	oldSe, ok1 := oldObj.(*corev1.Secret)
+	newSe, ok2 := newObj.(*corev1.Secret)
+	if ok1 && ok2 && reflect.DeepEqual(oldSe.Data, newSe.Data) {
+		return true
+	}
+	// the data may have changed, which is written by kmerge if the hash
+	// changed with it
+	return oldAnno[pkg.KmergeHashKey] != newAnno[pkg.KmergeHashKey]
+}
+
+// sameObject returns whether the objects only differ in the managed fields
+// and the resource version, which kmerge changes by migrating its fields.
+func sameObject(oldObj, newObj client.Object) bool {
+	oldCopy := oldObj.DeepCopyObject().(client.Object)
+	newCopy := newObj.DeepCopyObject().(client.Object)
+	for _, obj := range []client.Object{oldCopy, newCopy} {
+		obj.SetManagedFields(nil)
+		obj.SetResourceVersion("")
+	}
+	return reflect.DeepEqual(oldCopy, newCopy)
+}
+
+// secretPredicate drops the events of secrets without kmerge annotations or
+// labels, unless they had them before, and the updates of status only.
+func secretPredicate() predicate.Predicate {
+	return predicate.Funcs{
+		CreateFunc: func(e event.CreateEvent) bool {
+			return relevant(e.Object)
+		},
+		DeleteFunc: func(e event.DeleteEvent) bool {
+			return relevant(e.Object)
+		},
+		UpdateFunc: func(e event.UpdateEvent) bool {
+			if !relevant(e.ObjectOld) && !relevant(e.ObjectNew) {
+				return false
+			}
+			return !statusOnly(e.ObjectOld, e.ObjectNew)
+		},
+		GenericFunc: func(e event.GenericEvent) bool {
+			return relevant(e.Object)
+		},
+	}
+}
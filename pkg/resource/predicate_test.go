@@ -0,0 +1,78 @@
+// Copyright 2023 Authors of kmerge
+// SPDX-License-Identifier: Apache-2.0
+
+package resource
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/yylt/kmerge/pkg"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+)
+
+func TestSecretPredicate(t *testing.T) {
+	p := secretPredicate()
+	source := map[string]string{pkg.KmergeNameKey: "group"}
+
+	plain := newTestSecret("a", "token", nil, map[string]string{"k": "v"})
+	assert.False(t, p.Create(event.CreateEvent{Object: plain}))
+	assert.False(t, p.Delete(event.DeleteEvent{Object: plain}))
+	preview := newTestSecret("a", "p"+pkg.KmergePreviewSuffix, map[string]string{pkg.KmergeHashKey: "sum"}, nil)
+	assert.False(t, p.Create(event.CreateEvent{Object: preview}))
+
+	src := newTestSecret("a", "src", source, map[string]string{"k": "v"})
+	assert.True(t, p.Create(event.CreateEvent{Object: src}))
+	assert.True(t, p.Delete(event.DeleteEvent{Object: src}))
+
+	update := func(oldObj, newObj *corev1.Secret) bool {
+		return p.Update(event.UpdateEvent{ObjectOld: oldObj, ObjectNew: newObj})
+	}
+
+	// unrelated secrets
+	changed := plain.DeepCopy()
+	changed.Data["k"] = []byte("new")
+	assert.False(t, update(plain, changed))
+
+	// the annotations are removed from a source
+	assert.True(t, update(src, plain))
+	// the data of a source
+	changed = src.DeepCopy()
+	changed.Data["k"] = []byte("new")
+	assert.True(t, update(src, changed))
+
+	// the merge written by kmerge
+	primary := newTestSecret("p", "primary", map[string]string{
+		pkg.KmergePrimaryKey: "",
+		pkg.KmergeNameKey:    "group",
+		pkg.KmergeHashKey:    "old",
+	}, map[string]string{"k": "old"})
+	merged := primary.DeepCopy()
+	merged.Annotations[pkg.KmergeHashKey] = "new"
+	merged.Data["k"] = []byte("new")
+	assert.False(t, update(primary, merged))
+
+	// a key added to the primary
+	changed = primary.DeepCopy()
+	changed.Data["other"] = []byte("")
+	assert.True(t, update(primary, changed))
+	// the primary annotations
+	changed = primary.DeepCopy()
+	changed.Annotations[pkg.KmergeTypeKey] = "json"
+	assert.True(t, update(primary, changed))
+
+	// the fields of kmerge migrated, seen through the metadata cache
+	meta := &metav1.PartialObjectMetadata{ObjectMeta: *primary.ObjectMeta.DeepCopy()}
+	meta.ResourceVersion = "1"
+	migrated := meta.DeepCopy()
+	migrated.ResourceVersion = "2"
+	migrated.ManagedFields = []metav1.ManagedFieldsEntry{
+		managedEntry(FieldManager, metav1.ManagedFieldsOperationApply, `{"f:data":{"f:k":{}}}`),
+	}
+	assert.False(t, p.Update(event.UpdateEvent{ObjectOld: meta, ObjectNew: migrated}))
+	// other metadata changed
+	migrated.Labels = map[string]string{"app": "a"}
+	assert.True(t, p.Update(event.UpdateEvent{ObjectOld: meta, ObjectNew: migrated}))
+}
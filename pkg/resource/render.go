@@ -0,0 +1,341 @@
+// Copyright 2023 Authors of kmerge
+// SPDX-License-Identifier: Apache-2.0
+
+package resource
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/emirpasic/gods/sets/hashset"
+	"github.com/yylt/kmerge/pkg"
+	"github.com/yylt/kmerge/pkg/util"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// Preview is the result of merging a primary offline.
+type Preview struct {
+	// Primary is the primary as read.
+	Primary *corev1.Secret
+
+	// Merged is the primary after merge, nil if Err is set.
+	Merged *corev1.Secret
+
+	// Sources are namespace/name of the merged secrets, in merge order.
+	Sources []string
+
+	Err error
+}
+
+func newRes(nsname string) *res {
+	return &res{
+		primary: nsname,
+		fromns:  hashset.New(),
+		k:       pkg.Textk,
+	}
+}
+
+// parse sets the group name, source namespaces, kind, mode, policy, rollout
+// and debounce from the primary annotations, an invalid kind falls back to text
+// and an invalid duration to zero.
+func (r *res) parse(annotations map[string]string) {
+	r.name = annotations[pkg.KmergeNameKey]
+	r.fromns.Clear()
+	if fromns, ok := annotations[pkg.KmergeFromNsKey]; ok {
+		for _, v := range strings.Split(fromns, ",") {
+			if v = strings.TrimSpace(v); v != "" {
+				r.fromns.Add(v)
+			}
+		}
+	}
+	r.dryRun = annotations[pkg.KmergeModeKey] == pkg.DryRunMode
+	r.rollout = annotations[pkg.KmergeRolloutKey] == "true"
+	r.skipInvalid = annotations[pkg.KmergePolicyKey] == pkg.SkipInvalidPolicy
+	r.window = util.Window{
+		Debounce: parseDuration(annotations[pkg.KmergeDebounceKey]),
+		MaxWait:  parseDuration(annotations[pkg.KmergeMaxWaitKey]),
+	}
+	r.k = pkg.Textk
+	if kind := annotations[pkg.KmergeTypeKey]; kind != "" {
+		k, ok := pkg.ValidKind(kind)
+		if ok {
+			r.k = k
+		}
+	}
+}
+
+func parseDuration(s string) time.Duration {
+	d, err := time.ParseDuration(s)
+	if err != nil || d < 0 {
+		return 0
+	}
+	return d
+}
+
+// SourceNamespaces returns the namespaces a primary merges from, empty means
+// all namespaces.
+func SourceNamespaces(annotations map[string]string) []string {
+	se := newRes("")
+	se.parse(annotations)
+	var list []string
+	for _, v := range se.fromns.Values() {
+		list = append(list, v.(string))
+	}
+	sort.Strings(list)
+	return list
+}
+
+// isPrimary returns whether the annotations mark a primary.
+func isPrimary(annotations map[string]string) bool {
+	_, hasPrimary := annotations[pkg.KmergePrimaryKey]
+	_, hasName := annotations[pkg.KmergeNameKey]
+	return hasPrimary && hasName
+}
+
+// mergeFor returns the merge function of kind.
+func mergeFor(k pkg.Kind) Mergefn {
+	return func(s [][]byte) ([]byte, error) {
+		switch k {
+		case pkg.Textk:
+			return TextMerge(s)
+		case pkg.Jsonk:
+			return JsonMerge(s)
+		case pkg.Yamlk:
+			return YamlMerge(s)
+		default:
+			return nil, fmt.Errorf("not support")
+		}
+	}
+}
+
+// render merges every key of the primary from the sources of se into a copy
+// of in, and returns the copy with the content hash. With the skip-invalid
+// policy the invalid sources are left out, and named in the skipped
+// annotation of the copy.
+func render(infos seInfos, in *corev1.Secret, se *res) (*corev1.Secret, string, error) {
+	var (
+		values = map[string]*bytes.Buffer{}
+
+		vs      = [][]byte{}
+		fn      = mergeFor(se.k)
+		skipped []string
+	)
+	if se.skipInvalid {
+		infos, skipped = validSources(infos, in, se.k)
+	}
+	inCopy := in.DeepCopy()
+	defer func() {
+		for _, buf := range values {
+			util.PutBuf(buf)
+		}
+	}()
+	for k := range inCopy.Data {
+		values[k] = util.GetBuf()
+	}
+
+	for k, buf := range values {
+		vs = vs[:0]
+		for _, info := range infos {
+			v, ok := info.Data[k]
+			if ok {
+				vs = append(vs, v)
+			}
+		}
+		v, err := fn(vs)
+		if err != nil {
+			return nil, "", err
+		}
+		buf.Write(v)
+	}
+	for k, buf := range values {
+		// the buffer goes back to pool
+		inCopy.Data[k] = bytes.Clone(buf.Bytes())
+	}
+	if len(skipped) > 0 {
+		if inCopy.Annotations == nil {
+			inCopy.Annotations = map[string]string{}
+		}
+		inCopy.Annotations[pkg.KmergeSkippedKey] = strings.Join(skipped, ",")
+	} else {
+		delete(inCopy.Annotations, pkg.KmergeSkippedKey)
+	}
+	return inCopy, contentSum(se, infos, skipped, inCopy.Data), nil
+}
+
+// validSources returns the sources whose keys merged into in are valid k, and
+// namespace/name of the others.
+func validSources(infos seInfos, in *corev1.Secret, k pkg.Kind) (seInfos, []string) {
+	var (
+		valid   seInfos
+		skipped []string
+	)
+	for _, v := range infos {
+		ok := true
+		for key := range in.Data {
+			if d, has := v.Data[key]; has && parseable(k, d) != nil {
+				ok = false
+				break
+			}
+		}
+		if ok {
+			valid = append(valid, v)
+		} else {
+			skipped = append(skipped, fmt.Sprintf("%s/%s", v.Namespace, v.Name))
+		}
+	}
+	return valid, skipped
+}
+
+// parseable returns the error to merge v as k.
+func parseable(k pkg.Kind, v []byte) error {
+	if k == pkg.Textk {
+		return nil
+	}
+	src := map[string]any{}
+	return k.Unmarshal(v, &src)
+}
+
+// sumPrefix marks the hashes written by contentSum, hashes without it are
+// written by older versions.
+const sumPrefix = "sha256:"
+
+// contentSum returns the hash kept in the hash annotation. It covers the
+// merge configuration of se, the identities of the sources in merge order,
+// the skipped sources and the merged data, every field is length prefixed so
+// that moving bytes between fields changes the hash.
+func contentSum(se *res, infos seInfos, skipped []string, data map[string][]byte) string {
+	h := sha256.New()
+
+	writeField(h, []byte(se.k))
+	writeField(h, []byte(se.name))
+	writeField(h, []byte(strconv.FormatBool(se.skipInvalid)))
+	var fromns []string
+	for _, v := range se.fromns.Values() {
+		fromns = append(fromns, v.(string))
+	}
+	sort.Strings(fromns)
+	writeCount(h, len(fromns))
+	for _, v := range fromns {
+		writeField(h, []byte(v))
+	}
+
+	writeCount(h, len(infos))
+	for _, v := range infos {
+		writeField(h, []byte(v.Namespace))
+		writeField(h, []byte(v.Name))
+		writeField(h, []byte(v.UID))
+	}
+	writeCount(h, len(skipped))
+	for _, v := range skipped {
+		writeField(h, []byte(v))
+	}
+
+	keys := make([]string, 0, len(data))
+	for k := range data {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	writeCount(h, len(keys))
+	for _, k := range keys {
+		writeField(h, []byte(k))
+		writeField(h, data[k])
+	}
+	return sumPrefix + hex.EncodeToString(h.Sum(nil))
+}
+
+func writeCount(h hash.Hash, n int) {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], uint64(n))
+	h.Write(b[:])
+}
+
+func writeField(h hash.Hash, b []byte) {
+	writeCount(h, len(b))
+	h.Write(b)
+}
+
+// inSync returns whether the primary holds out, the merge of hash sum, which
+// is false after the sources, the configuration or the primary itself
+// changed.
+func inSync(in, out *corev1.Secret, sum string) bool {
+	return in.Annotations[pkg.KmergeHashKey] == sum && sameData(in.Data, out.Data)
+}
+
+// legacySum returns whether the primary holds out with a hash written by an
+// older version, which is rewritten without a change of data.
+func legacySum(in, out *corev1.Secret) bool {
+	sum, ok := in.Annotations[pkg.KmergeHashKey]
+	return ok && !strings.HasPrefix(sum, sumPrefix) && sameData(in.Data, out.Data)
+}
+
+func sameData(a, b map[string][]byte) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k, v := range a {
+		bv, ok := b[k]
+		if !ok || !bytes.Equal(v, bv) {
+			return false
+		}
+	}
+	return true
+}
+
+// selectSources returns the sources of the primary in list, in merge order.
+func selectSources(list *corev1.SecretList, se *res) seInfos {
+	var infos seInfos
+	for _, v := range filter(list, se) {
+		if se.fromns.Size() == 0 || se.fromns.Contains(v.Namespace) {
+			infos = append(infos, v)
+		}
+	}
+	sort.Sort(infos)
+	return infos
+}
+
+// PreviewSecrets merges every primary in secrets with the sources in secrets,
+// using the same discovery, ordering and merge as the controller.
+func PreviewSecrets(secrets []corev1.Secret) []Preview {
+	var (
+		list    = &corev1.SecretList{Items: secrets}
+		results []Preview
+	)
+	for i := range secrets {
+		in := &secrets[i]
+		if !isPrimary(in.Annotations) {
+			continue
+		}
+		se := newRes(fmt.Sprintf("%s/%s", in.Namespace, in.Name))
+		se.parse(in.Annotations)
+
+		infos := selectSources(list, se)
+		merged := infos
+		if se.skipInvalid {
+			merged, _ = validSources(infos, in, se.k)
+		}
+		result := Preview{Primary: in}
+		for _, v := range merged {
+			result.Sources = append(result.Sources, fmt.Sprintf("%s/%s", v.Namespace, v.Name))
+		}
+		out, sum, err := render(infos, in, se)
+		if err != nil {
+			result.Err = err
+		} else {
+			if out.Annotations == nil {
+				out.Annotations = map[string]string{}
+			}
+			out.Annotations[pkg.KmergeHashKey] = sum
+			result.Merged = out
+		}
+		results = append(results, result)
+	}
+	return results
+}
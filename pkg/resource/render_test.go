@@ -0,0 +1,124 @@
+// Copyright 2023 Authors of kmerge
+// SPDX-License-Identifier: Apache-2.0
+
+package resource
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/yylt/kmerge/pkg"
+	"github.com/yylt/kmerge/pkg/util"
+	corev1 "k8s.io/api/core/v1"
+)
+
+func TestPreviewSecrets(t *testing.T) {
+	primary := map[string]string{
+		pkg.KmergePrimaryKey: "",
+		pkg.KmergeNameKey:    "group",
+		pkg.KmergeTypeKey:    "json",
+		pkg.KmergeFromNsKey:  "b, a",
+	}
+	source := map[string]string{pkg.KmergeNameKey: "group"}
+
+	results := PreviewSecrets([]corev1.Secret{
+		*newTestSecret("p", "primary", primary, map[string]string{"k": "{}", "only": "{}"}),
+		*newTestSecret("b", "src", source, map[string]string{"k": `{"a":2,"b":1}`}),
+		*newTestSecret("a", "src", source, map[string]string{"k": `{"a":1,"c":1}`, "only": `{"x":1}`}),
+		*newTestSecret("c", "src", source, map[string]string{"k": `{"z":1}`}),
+		*newTestSecret("a", "other", nil, map[string]string{"k": `{"y":1}`}),
+	})
+	assert.Len(t, results, 1)
+	r := results[0]
+	assert.NoError(t, r.Err)
+	assert.Equal(t, []string{"a/src", "b/src"}, r.Sources)
+	assert.JSONEq(t, `{"a":2,"b":1,"c":1}`, string(r.Merged.Data["k"]))
+	assert.JSONEq(t, `{"x":1}`, string(r.Merged.Data["only"]))
+	assert.NotEmpty(t, r.Merged.Annotations[pkg.KmergeHashKey])
+	// the input is not modified
+	assert.Equal(t, "{}", string(r.Primary.Data["k"]))
+
+	results = PreviewSecrets([]corev1.Secret{
+		*newTestSecret("p", "primary", primary, map[string]string{"k": "{}"}),
+		*newTestSecret("a", "src", source, map[string]string{"k": `{"a":`}),
+	})
+	assert.Len(t, results, 1)
+	assert.Error(t, results[0].Err)
+	assert.Nil(t, results[0].Merged)
+}
+
+func TestParseWindow(t *testing.T) {
+	se := newRes("p/primary")
+	se.parse(map[string]string{
+		pkg.KmergeDebounceKey: "5s",
+		pkg.KmergeMaxWaitKey:  "1m",
+	})
+	assert.Equal(t, util.Window{Debounce: 5 * time.Second, MaxWait: time.Minute}, se.window)
+
+	se.parse(map[string]string{
+		pkg.KmergeDebounceKey: "soon",
+		pkg.KmergeMaxWaitKey:  "-1s",
+	})
+	assert.Equal(t, util.Window{}, se.window)
+}
+
+func TestContentSum(t *testing.T) {
+	se := newRes("p/primary")
+	se.parse(map[string]string{pkg.KmergeNameKey: "group"})
+	src := seInfos{{Secret: newTestSecret("a", "src", nil, nil)}}
+	sum := func(se *res, infos seInfos, data map[string]string) string {
+		return contentSum(se, infos, nil, newTestSecret("", "", nil, data).Data)
+	}
+
+	base := sum(se, src, map[string]string{"ab": "c", "d": "e"})
+	assert.True(t, strings.HasPrefix(base, sumPrefix))
+	assert.Equal(t, base, sum(se, src, map[string]string{"d": "e", "ab": "c"}))
+
+	// renamed keys and bytes moved between keys or values
+	assert.NotEqual(t, base, sum(se, src, map[string]string{"ab": "c", "x": "e"}))
+	assert.NotEqual(t, base, sum(se, src, map[string]string{"a": "bc", "d": "e"}))
+	assert.NotEqual(t, base, sum(se, src, map[string]string{"ab": "cd", "": "e"}))
+
+	// sources and configuration
+	assert.NotEqual(t, base, sum(se, nil, map[string]string{"ab": "c", "d": "e"}))
+	other := seInfos{{Secret: newTestSecret("b", "src", nil, nil)}}
+	assert.NotEqual(t, base, sum(se, other, map[string]string{"ab": "c", "d": "e"}))
+	json := newRes("p/primary")
+	json.parse(map[string]string{pkg.KmergeNameKey: "group", pkg.KmergeTypeKey: "json"})
+	assert.NotEqual(t, base, sum(json, src, map[string]string{"ab": "c", "d": "e"}))
+	fromns := newRes("p/primary")
+	fromns.parse(map[string]string{pkg.KmergeNameKey: "group", pkg.KmergeFromNsKey: "a"})
+	assert.NotEqual(t, base, sum(fromns, src, map[string]string{"ab": "c", "d": "e"}))
+}
+
+func TestSkipInvalid(t *testing.T) {
+	primary := map[string]string{
+		pkg.KmergePrimaryKey: "",
+		pkg.KmergeNameKey:    "group",
+		pkg.KmergeTypeKey:    "json",
+	}
+	source := map[string]string{pkg.KmergeNameKey: "group"}
+	secrets := []corev1.Secret{
+		*newTestSecret("p", "primary", primary, map[string]string{"k": "{}"}),
+		*newTestSecret("a", "src", source, map[string]string{"k": `{"a":1}`}),
+		*newTestSecret("b", "src", source, map[string]string{"k": `{"b":`}),
+		// keys not in the primary are not merged
+		*newTestSecret("c", "src", source, map[string]string{"k": `{"c":1}`, "other": "["}),
+	}
+
+	// strict fails the merge
+	results := PreviewSecrets(secrets)
+	assert.Len(t, results, 1)
+	assert.Error(t, results[0].Err)
+
+	primary[pkg.KmergePolicyKey] = pkg.SkipInvalidPolicy
+	results = PreviewSecrets(secrets)
+	assert.Len(t, results, 1)
+	r := results[0]
+	assert.NoError(t, r.Err)
+	assert.Equal(t, []string{"a/src", "c/src"}, r.Sources)
+	assert.JSONEq(t, `{"a":1,"c":1}`, string(r.Merged.Data["k"]))
+	assert.Equal(t, "b/src", r.Merged.Annotations[pkg.KmergeSkippedKey])
+}
@@ -0,0 +1,116 @@
+// Copyright 2023 Authors of kmerge
+// SPDX-License-Identifier: Apache-2.0
+
+package resource
+
+import (
+	"strings"
+	"time"
+
+	"github.com/yylt/kmerge/pkg"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/klog/v2"
+)
+
+// ReasonDrifted is the Event reason of a primary which differs from the
+// merge of its sources.
+const ReasonDrifted = "Drifted"
+
+// WithResync recomputes every primary at interval, and merges the drifted
+// ones again. Zero disables resync.
+func WithResync(interval time.Duration) Option {
+	return func(n *manager) {
+		n.resyncInterval = interval
+	}
+}
+
+func (n *manager) processResync() {
+	if n.resyncInterval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(n.resyncInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			n.resync()
+		case <-n.ctx.Done():
+			return
+		}
+	}
+}
+
+// resync recomputes the primaries merged by this replica, and enqueues the
+// drifted ones and the ones with a legacy hash. It returns the drifted
+// primaries.
+func (n *manager) resync() []string {
+	var keys, drifted, legacy []string
+	n.mu.RLock()
+	for k, v := range n.data {
+		// dry-run primaries are not patched, paused ones are left alone
+		if v.scheduled && !v.paused && !v.dryRun {
+			keys = append(keys, k)
+		}
+	}
+	n.mu.RUnlock()
+
+	for _, k := range keys {
+		in, ok, stale, err := n.drifted(k)
+		if err != nil {
+			klog.Errorf("resync secret %s failed: %v", k, err)
+			continue
+		}
+		if stale {
+			legacy = append(legacy, k)
+		}
+		if !ok {
+			continue
+		}
+		var count int
+		n.mu.Lock()
+		if v, ok := n.data[k]; ok {
+			v.drifts++
+			count = v.drifts
+		}
+		n.mu.Unlock()
+		n.recorder.Eventf(in, corev1.EventTypeWarning, ReasonDrifted,
+			"content differs from the merge of sources, merge again (drifted %d times)", count)
+		drifted = append(drifted, k)
+	}
+	klog.Infof("resync %d primaries, %d drifted, %d legacy hashes", len(keys), len(drifted), len(legacy))
+	n.push(drifted...)
+	n.push(legacy...)
+	return drifted
+}
+
+// drifted returns the primary and whether it differs from the merge of its
+// sources. A primary holding the merge with a legacy hash is stale, but not
+// drifted.
+func (n *manager) drifted(key string) (in *corev1.Secret, drifted bool, stale bool, err error) {
+	name := strings.Split(key, string(types.Separator))
+	se := n.getInfo(key)
+	if se == nil || len(name) != 2 {
+		return nil, false, false, nil
+	}
+	in, err = n.readPrimary(types.NamespacedName{Namespace: name[0], Name: name[1]}, false)
+	if err != nil {
+		return nil, false, false, err
+	}
+	infos, err := n.sources(se)
+	if err != nil {
+		return nil, false, false, err
+	}
+	out, sum, err := render(infos, in, se)
+	if err != nil {
+		return nil, false, false, err
+	}
+	if inSync(in, out, sum) {
+		return in, false, false, nil
+	}
+	if legacySum(in, out) {
+		return in, false, true, nil
+	}
+	klog.Warningf("secret %s drifted, hash %q, merged %q", key, in.Annotations[pkg.KmergeHashKey], sum)
+	return in, true, false, nil
+}
@@ -0,0 +1,90 @@
+// Copyright 2023 Authors of kmerge
+// SPDX-License-Identifier: Apache-2.0
+
+package resource
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/yylt/kmerge/pkg"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+)
+
+func TestResync(t *testing.T) {
+	annotations := map[string]string{
+		pkg.KmergePrimaryKey: "",
+		pkg.KmergeNameKey:    "group",
+	}
+	n := newTestManager(
+		newTestSecret("p", "primary", annotations, map[string]string{"k": "old"}),
+		newTestSecret("a", "src", map[string]string{pkg.KmergeNameKey: "group"}, map[string]string{"k": "new"}),
+	)
+	recorder := n.recorder.(*record.FakeRecorder)
+	info := newRes("p/primary")
+	info.parse(annotations)
+	info.scheduled = true
+	n.data["p/primary"] = info
+
+	// never merged
+	assert.Equal(t, []string{"p/primary"}, n.resync())
+	assert.Contains(t, <-recorder.Events, ReasonDrifted)
+	assert.Equal(t, []string{"p/primary"}, drainQueue(n))
+	assert.NoError(t, n.handle("p/primary"))
+	assert.Empty(t, n.resync())
+
+	// edited by hand
+	key := types.NamespacedName{Namespace: "p", Name: "primary"}
+	primary := &corev1.Secret{}
+	assert.NoError(t, n.Get(n.ctx, key, primary))
+	primary.Data["k"] = []byte("edited")
+	assert.NoError(t, n.Update(n.ctx, primary))
+
+	assert.Equal(t, []string{"p/primary"}, n.resync())
+	assert.Contains(t, <-recorder.Events, "drifted 2 times")
+	assert.Equal(t, 2, n.Primaries()[0].Drifts)
+	assert.NoError(t, n.handle("p/primary"))
+	assert.NoError(t, n.Get(n.ctx, key, primary))
+	assert.Equal(t, "new", string(primary.Data["k"]))
+	assert.Empty(t, n.resync())
+
+	// paused primaries are left alone
+	assert.NoError(t, n.Pause("p/primary"))
+	primary.Data["k"] = []byte("edited")
+	assert.NoError(t, n.Update(n.ctx, primary))
+	assert.Empty(t, n.resync())
+}
+
+func TestResyncLegacyHash(t *testing.T) {
+	annotations := map[string]string{
+		pkg.KmergePrimaryKey: "",
+		pkg.KmergeNameKey:    "group",
+		// md5 hash written by older versions
+		pkg.KmergeHashKey: "c2b2f8b1a7d6e2a3c0c5e3c1b9d2f4a1",
+	}
+	n := newTestManager(
+		newTestSecret("p", "primary", annotations, map[string]string{"k": "new"}),
+		newTestSecret("a", "src", map[string]string{pkg.KmergeNameKey: "group"}, map[string]string{"k": "new"}),
+	)
+	recorder := n.recorder.(*record.FakeRecorder)
+	info := newRes("p/primary")
+	info.parse(annotations)
+	info.scheduled = true
+	n.data["p/primary"] = info
+
+	// not drifted, but merged again to rewrite the hash
+	assert.Empty(t, n.resync())
+	assert.Empty(t, recorder.Events)
+	assert.Equal(t, []string{"p/primary"}, drainQueue(n))
+	assert.NoError(t, n.handle("p/primary"))
+
+	primary := &corev1.Secret{}
+	assert.NoError(t, n.Get(n.ctx, types.NamespacedName{Namespace: "p", Name: "primary"}, primary))
+	assert.True(t, strings.HasPrefix(primary.Annotations[pkg.KmergeHashKey], sumPrefix))
+	assert.Equal(t, "new", string(primary.Data["k"]))
+	assert.Empty(t, n.resync())
+	assert.Empty(t, drainQueue(n))
+}
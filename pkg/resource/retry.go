@@ -0,0 +1,115 @@
+// Copyright 2023 Authors of kmerge
+// SPDX-License-Identifier: Apache-2.0
+
+package resource
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/util/workqueue"
+	"k8s.io/klog/v2"
+)
+
+const (
+	defaultRetryBaseDelay = time.Second
+	defaultRetryMaxDelay  = 5 * time.Minute
+	defaultRetryAttempts  = 10
+)
+
+// WithRetry sets the per primary exponential delay of failed merges, a
+// primary is given up after attempts retries until it is triggered again.
+func WithRetry(baseDelay, maxDelay time.Duration, attempts int) Option {
+	return func(n *manager) {
+		n.retry.queue.ShutDown()
+		n.retry = newRetry(baseDelay, maxDelay, attempts)
+	}
+}
+
+// retry requeues failed merges through a per primary rate limiter.
+type retry struct {
+	queue    workqueue.RateLimitingInterface
+	attempts int
+
+	mu sync.Mutex
+	// primaries to read from apiserver on next merge
+	refresh map[string]struct{}
+}
+
+func newRetry(baseDelay, maxDelay time.Duration, attempts int) *retry {
+	return &retry{
+		queue: workqueue.NewRateLimitingQueueWithConfig(
+			workqueue.NewItemExponentialFailureRateLimiter(baseDelay, maxDelay),
+			workqueue.RateLimitingQueueConfig{Name: "kmerge-retry"},
+		),
+		attempts: attempts,
+		refresh:  map[string]struct{}{},
+	}
+}
+
+// takeRefresh returns whether key must be read from apiserver, and clears it.
+func (r *retry) takeRefresh(key string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	_, ok := r.refresh[key]
+	delete(r.refresh, key)
+	return ok
+}
+
+// done records the merge result of key, a failed merge is requeued with
+// delay until the attempts are used up.
+func (r *retry) done(key string, err error) {
+	if err == nil || isFieldConflict(err) {
+		// field conflicts are left to their owners, the primary is
+		// merged again on its next change
+		r.queue.Forget(key)
+		return
+	}
+	if apierrors.IsConflict(err) {
+		r.mu.Lock()
+		r.refresh[key] = struct{}{}
+		r.mu.Unlock()
+	}
+	if n := r.queue.NumRequeues(key); n >= r.attempts {
+		klog.Errorf("merge secret %s failed %d times, give up until next change: %v", key, n+1, err)
+		r.queue.Forget(key)
+		return
+	}
+	r.queue.AddRateLimited(key)
+}
+
+// isFieldConflict returns whether err is a server-side apply conflict on
+// fields owned by other managers, unlike a conflict on the resource version
+// it is not resolved by retrying.
+func isFieldConflict(err error) bool {
+	var status *apierrors.StatusError
+	return errors.As(err, &status) && apierrors.HasStatusCause(status, metav1.CauseTypeFieldManagerConflict)
+}
+
+// merge merges the primary and requeues it on failure.
+func (n *manager) merge(key string) error {
+	err := n.handle(key)
+	n.retry.done(key, err)
+	return err
+}
+
+// processRetry triggers the primaries whose retry delay passed.
+func (n *manager) processRetry() {
+	go func() {
+		<-n.ctx.Done()
+		n.retry.queue.ShutDown()
+	}()
+	for {
+		item, shutdown := n.retry.queue.Get()
+		if shutdown {
+			return
+		}
+		key := item.(string)
+		klog.V(2).Infof("retry merge secret %s", key)
+		n.push(key)
+		n.retry.queue.Done(key)
+	}
+}
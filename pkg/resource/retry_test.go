@@ -0,0 +1,65 @@
+// Copyright 2023 Authors of kmerge
+// SPDX-License-Identifier: Apache-2.0
+
+package resource
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+func TestRetryDone(t *testing.T) {
+	r := newRetry(time.Millisecond, 10*time.Millisecond, 2)
+	defer r.queue.ShutDown()
+
+	failed := fmt.Errorf("failed")
+	for i := 0; i < 2; i++ {
+		r.done("ns/a", failed)
+		item, _ := r.queue.Get()
+		assert.Equal(t, "ns/a", item)
+		r.queue.Done(item)
+	}
+	assert.Equal(t, 2, r.queue.NumRequeues("ns/a"))
+
+	// attempts used up
+	r.done("ns/a", failed)
+	assert.Equal(t, 0, r.queue.NumRequeues("ns/a"))
+	assert.Equal(t, 0, r.queue.Len())
+
+	// conflict reads the primary from apiserver on retry
+	r.done("ns/b", apierrors.NewConflict(schema.GroupResource{Resource: "secrets"}, "b", failed))
+	assert.True(t, r.takeRefresh("ns/b"))
+	assert.False(t, r.takeRefresh("ns/b"))
+
+	r.done("ns/b", nil)
+	assert.Equal(t, 0, r.queue.NumRequeues("ns/b"))
+
+	// field conflicts are not retried
+	r.done("ns/c", fmt.Errorf("apply: %w", newFieldConflict("c")))
+	assert.Equal(t, 0, r.queue.NumRequeues("ns/c"))
+	assert.False(t, r.takeRefresh("ns/c"))
+}
+
+func newFieldConflict(name string) error {
+	return &apierrors.StatusError{ErrStatus: metav1.Status{
+		Status:  metav1.StatusFailure,
+		Message: `Apply failed with 1 conflict: conflict with "kubectl-edit": .data.k`,
+		Code:    http.StatusConflict,
+		Reason:  metav1.StatusReasonConflict,
+		Details: &metav1.StatusDetails{
+			Name: name,
+			Causes: []metav1.StatusCause{{
+				Type:    metav1.CauseTypeFieldManagerConflict,
+				Message: `conflict with "kubectl-edit"`,
+				Field:   ".data.k",
+			}},
+		},
+	}}
+}
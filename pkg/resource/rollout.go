@@ -0,0 +1,127 @@
+// Copyright 2023 Authors of kmerge
+// SPDX-License-Identifier: Apache-2.0
+
+package resource
+
+import (
+	"github.com/yylt/kmerge/pkg"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/klog/v2"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const (
+	// ReasonRolledOut is the Event reason of a workload rolled out for a
+	// change of the primary.
+	ReasonRolledOut = "RolledOut"
+
+	// ReasonRolloutFailed is the Event reason of a workload failed to roll
+	// out.
+	ReasonRolloutFailed = "RolloutFailed"
+)
+
+// workload is a Deployment, StatefulSet or DaemonSet.
+type workload struct {
+	kind     string
+	obj      client.Object
+	template *corev1.PodTemplateSpec
+}
+
+// workloads lists the workloads in ns from apiserver, they are not cached.
+func (m *manager) workloads(ns string) ([]workload, error) {
+	var ws []workload
+
+	deploys := &appsv1.DeploymentList{}
+	if err := m.reader.List(m.ctx, deploys, client.InNamespace(ns)); err != nil {
+		return nil, err
+	}
+	for i := range deploys.Items {
+		v := &deploys.Items[i]
+		ws = append(ws, workload{kind: "Deployment", obj: v, template: &v.Spec.Template})
+	}
+
+	sts := &appsv1.StatefulSetList{}
+	if err := m.reader.List(m.ctx, sts, client.InNamespace(ns)); err != nil {
+		return nil, err
+	}
+	for i := range sts.Items {
+		v := &sts.Items[i]
+		ws = append(ws, workload{kind: "StatefulSet", obj: v, template: &v.Spec.Template})
+	}
+
+	ds := &appsv1.DaemonSetList{}
+	if err := m.reader.List(m.ctx, ds, client.InNamespace(ns)); err != nil {
+		return nil, err
+	}
+	for i := range ds.Items {
+		v := &ds.Items[i]
+		ws = append(ws, workload{kind: "DaemonSet", obj: v, template: &v.Spec.Template})
+	}
+	return ws, nil
+}
+
+// rollout sets the hash sum of the primary on the pod template of the
+// workloads consuming it, which rolls them out. Workloads annotated with
+// rollout "false" are skipped. Failures are recorded as Events, the merge is
+// not retried for them.
+func (m *manager) rollout(primary *corev1.Secret, sum string) {
+	ws, err := m.workloads(primary.Namespace)
+	if err != nil {
+		klog.Errorf("list workloads of secret %s/%s failed: %v", primary.Namespace, primary.Name, err)
+		m.recorder.Eventf(primary, corev1.EventTypeWarning, ReasonRolloutFailed, "list workloads: %v", err)
+		return
+	}
+	for _, w := range ws {
+		if w.obj.GetAnnotations()[pkg.KmergeRolloutKey] == "false" {
+			continue
+		}
+		if !consumes(&w.template.Spec, primary.Name) || w.template.Annotations[pkg.KmergeSecretHashKey] == sum {
+			continue
+		}
+		patch := client.MergeFrom(w.obj.DeepCopyObject().(client.Object))
+		if w.template.Annotations == nil {
+			w.template.Annotations = map[string]string{}
+		}
+		w.template.Annotations[pkg.KmergeSecretHashKey] = sum
+		if err = m.Patch(m.ctx, w.obj, patch); err != nil {
+			klog.Errorf("roll out %s %s/%s failed: %v", w.kind, w.obj.GetNamespace(), w.obj.GetName(), err)
+			m.recorder.Eventf(primary, corev1.EventTypeWarning, ReasonRolloutFailed, "roll out %s %s: %v", w.kind, w.obj.GetName(), err)
+			continue
+		}
+		klog.Infof("roll out %s %s/%s for secret %s", w.kind, w.obj.GetNamespace(), w.obj.GetName(), primary.Name)
+		m.recorder.Eventf(primary, corev1.EventTypeNormal, ReasonRolledOut, "roll out %s %s", w.kind, w.obj.GetName())
+	}
+}
+
+// consumes returns whether the pod spec references the secret name through
+// volumes, envFrom or env.
+func consumes(spec *corev1.PodSpec, name string) bool {
+	for _, v := range spec.Volumes {
+		if v.Secret != nil && v.Secret.SecretName == name {
+			return true
+		}
+		if v.Projected == nil {
+			continue
+		}
+		for _, p := range v.Projected.Sources {
+			if p.Secret != nil && p.Secret.Name == name {
+				return true
+			}
+		}
+	}
+	containers := append(append([]corev1.Container{}, spec.InitContainers...), spec.Containers...)
+	for _, c := range containers {
+		for _, e := range c.EnvFrom {
+			if e.SecretRef != nil && e.SecretRef.Name == name {
+				return true
+			}
+		}
+		for _, e := range c.Env {
+			if e.ValueFrom != nil && e.ValueFrom.SecretKeyRef != nil && e.ValueFrom.SecretKeyRef.Name == name {
+				return true
+			}
+		}
+	}
+	return false
+}
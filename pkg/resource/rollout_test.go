@@ -0,0 +1,97 @@
+// Copyright 2023 Authors of kmerge
+// SPDX-License-Identifier: Apache-2.0
+
+package resource
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/yylt/kmerge/pkg"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+func newTestDeployment(ns, name string, annotations map[string]string, spec corev1.PodSpec) *appsv1.Deployment {
+	return &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{Namespace: ns, Name: name, Annotations: annotations},
+		Spec:       appsv1.DeploymentSpec{Template: corev1.PodTemplateSpec{Spec: spec}},
+	}
+}
+
+func TestRollout(t *testing.T) {
+	annotations := map[string]string{
+		pkg.KmergePrimaryKey: "",
+		pkg.KmergeNameKey:    "group",
+		pkg.KmergeRolloutKey: "true",
+	}
+	env := corev1.PodSpec{Containers: []corev1.Container{{
+		Env: []corev1.EnvVar{{Name: "K", ValueFrom: &corev1.EnvVarSource{
+			SecretKeyRef: &corev1.SecretKeySelector{LocalObjectReference: corev1.LocalObjectReference{Name: "primary"}, Key: "k"},
+		}}},
+	}}}
+	volume := corev1.PodSpec{Volumes: []corev1.Volume{{
+		VolumeSource: corev1.VolumeSource{Secret: &corev1.SecretVolumeSource{SecretName: "primary"}},
+	}}}
+	sts := &appsv1.StatefulSet{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "p", Name: "sts"},
+		Spec: appsv1.StatefulSetSpec{Template: corev1.PodTemplateSpec{Spec: corev1.PodSpec{InitContainers: []corev1.Container{{
+			EnvFrom: []corev1.EnvFromSource{{SecretRef: &corev1.SecretEnvSource{LocalObjectReference: corev1.LocalObjectReference{Name: "primary"}}}},
+		}}}}},
+	}
+	ds := &appsv1.DaemonSet{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "p", Name: "ds"},
+		Spec: appsv1.DaemonSetSpec{Template: corev1.PodTemplateSpec{Spec: corev1.PodSpec{Volumes: []corev1.Volume{{
+			VolumeSource: corev1.VolumeSource{Projected: &corev1.ProjectedVolumeSource{Sources: []corev1.VolumeProjection{{
+				Secret: &corev1.SecretProjection{LocalObjectReference: corev1.LocalObjectReference{Name: "primary"}},
+			}}}},
+		}}}}},
+	}
+	n := newTestManager(
+		newTestSecret("p", "primary", annotations, map[string]string{"k": "old"}),
+		newTestSecret("a", "src", map[string]string{pkg.KmergeNameKey: "group"}, map[string]string{"k": "new"}),
+		newTestDeployment("p", "env", nil, env),
+		newTestDeployment("p", "volume", nil, volume),
+		newTestDeployment("p", "optout", map[string]string{pkg.KmergeRolloutKey: "false"}, env),
+		newTestDeployment("p", "other", nil, corev1.PodSpec{}),
+		newTestDeployment("q", "env", nil, env),
+		sts, ds,
+	)
+	recorder := n.recorder.(*record.FakeRecorder)
+	info := newRes("p/primary")
+	info.parse(annotations)
+	n.data["p/primary"] = info
+
+	assert.NoError(t, n.handle("p/primary"))
+	primary := &corev1.Secret{}
+	assert.NoError(t, n.Get(n.ctx, types.NamespacedName{Namespace: "p", Name: "primary"}, primary))
+	sum := primary.Annotations[pkg.KmergeHashKey]
+	assert.NotEmpty(t, sum)
+
+	hashOf := func(obj client.Object, template *corev1.PodTemplateSpec) string {
+		assert.NoError(t, n.Get(n.ctx, client.ObjectKeyFromObject(obj), obj))
+		return template.Annotations[pkg.KmergeSecretHashKey]
+	}
+	for _, name := range []string{"env", "volume"} {
+		d := newTestDeployment("p", name, nil, corev1.PodSpec{})
+		assert.Equal(t, sum, hashOf(d, &d.Spec.Template), name)
+	}
+	assert.Equal(t, sum, hashOf(sts, &sts.Spec.Template))
+	assert.Equal(t, sum, hashOf(ds, &ds.Spec.Template))
+	for _, key := range []types.NamespacedName{{Namespace: "p", Name: "optout"}, {Namespace: "p", Name: "other"}, {Namespace: "q", Name: "env"}} {
+		d := newTestDeployment(key.Namespace, key.Name, nil, corev1.PodSpec{})
+		assert.Empty(t, hashOf(d, &d.Spec.Template), key.String())
+	}
+	assert.Len(t, recorder.Events, 4)
+	for len(recorder.Events) > 0 {
+		assert.Contains(t, <-recorder.Events, ReasonRolledOut)
+	}
+
+	// an unchanged merge rolls out nothing
+	assert.NoError(t, n.handle("p/primary"))
+	assert.Empty(t, recorder.Events)
+}
@@ -1,30 +1,49 @@
 package resource
 
 import (
-	"bytes"
 	"context"
-	"crypto/md5"
-	"encoding/hex"
 	"fmt"
 	"sort"
 	"strings"
 	"sync"
 	"time"
 
+	"github.com/cenkalti/backoff/v4"
 	"github.com/emirpasic/gods/sets/hashset"
 	"github.com/yylt/kmerge/pkg"
 	"github.com/yylt/kmerge/pkg/util"
 	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/client-go/util/workqueue"
 	"k8s.io/klog/v2"
+	"k8s.io/utils/lru"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
 	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
 )
 
 var minWorkNumber = 3
 
+// FieldManager is the server-side apply field manager of kmerge.
+const FieldManager = "kmerge"
+
+// ReasonSkippedInvalid is the Event reason of a merge which skipped invalid
+// sources.
+const ReasonSkippedInvalid = "SkippedInvalid"
+
+// ReasonFieldConflict is the Event reason of a merge which could not apply
+// fields owned by other managers.
+const ReasonFieldConflict = "FieldConflict"
+
 type res struct {
-	t *util.Trigger
+	// merged by this replica
+	scheduled bool
+
 	k pkg.Kind
 
 	// namespace/name
@@ -36,6 +55,47 @@ type res struct {
 	// sync from namespace
 	// nil mean allnamespace
 	fromns *hashset.Set
+
+	// paused primary is not merged on triggers
+	paused bool
+
+	// dry-run primary is not patched, see pkg.DryRunMode
+	dryRun bool
+
+	// debounce of merges
+	window util.Window
+
+	// roll out the consuming workloads on change
+	rollout bool
+
+	// skip the invalid sources instead of failing the merge
+	skipInvalid bool
+
+	// times the primary was found drifted by resync
+	drifts int
+}
+
+// Sharder decides which primaries are handled by this replica.
+type Sharder interface {
+	Owns(key string) bool
+}
+
+// Option configures the secret manager.
+type Option func(*manager)
+
+// WithNamespaces makes the manager only merge in the namespaces, which must
+// be the namespaces of the cache.
+func WithNamespaces(namespaces ...string) Option {
+	return func(n *manager) {
+		n.namespaces = sets.New(namespaces...)
+	}
+}
+
+// WithSharder makes the manager only merge the primaries owned by s.
+func WithSharder(s Sharder) Option {
+	return func(n *manager) {
+		n.sharder = s
+	}
 }
 
 type manager struct {
@@ -43,28 +103,99 @@ type manager struct {
 
 	ctx context.Context
 
-	// record primary secret ns/name
+	// nil mean all primaries are owned
+	sharder Sharder
+
+	// nil mean all namespaces are watched
+	namespaces sets.Set[string]
+
+	// record primary secret ns/name, guarded by mu
 	data map[string]*res
 
-	ch chan string
+	// waiters of the remerges by primary, guarded by mu
+	remerges map[string][]chan error
+
+	// primaries to trigger. It is unbounded and never written with mu
+	// held, so state changes do not wait for the workers.
+	queue workqueue.Interface
 
 	mu sync.RWMutex
+
+	work *work
+
+	// reader reads from apiserver directly
+	reader client.Reader
+
+	// cache reads the secret metadata from the cache, the client bypasses
+	// the cache for secrets, metadata included
+	cache client.Reader
+
+	retry *retry
+
+	// sources to primaries, guarded by mu
+	deps *depIndex
+
+	// runs the merges of scheduled primaries
+	sched *util.Scheduler
+
+	// full secrets by resourceVersion
+	secrets *lru.Cache
+
+	recorder record.EventRecorder
+
+	// 0 mean resync is disabled
+	resyncInterval time.Duration
+
+	// nil mean merges are not notified
+	notifier Notifier
 }
 
-func NewSecret(mgr ctrl.Manager, ctx context.Context, number int) (*manager, error) {
+func NewSecret(mgr ctrl.Manager, ctx context.Context, number int, opts ...Option) (*manager, error) {
 	n := &manager{
-		ctx:    ctx,
-		Client: mgr.GetClient(),
-		data:   map[string]*res{},
-		ch:     make(chan string, 128),
+		ctx:      ctx,
+		Client:   mgr.GetClient(),
+		data:     map[string]*res{},
+		remerges: map[string][]chan error{},
+		queue:    workqueue.NewWithConfig(workqueue.QueueConfig{Name: "kmerge"}),
+		work:     newWork(),
+		reader:   mgr.GetAPIReader(),
+		cache:    mgr.GetCache(),
+		retry:    newRetry(defaultRetryBaseDelay, defaultRetryMaxDelay, defaultRetryAttempts),
+		deps:     newDepIndex(),
+		secrets:  lru.New(defaultSecretCacheSize),
+		recorder: mgr.GetEventRecorderFor(FieldManager),
+	}
+	for _, opt := range opts {
+		opt(n)
+	}
+	err := mgr.GetFieldIndexer().IndexField(ctx, SecretMeta(), nameIndex, indexName)
+	if err != nil {
+		return nil, err
 	}
+	err = mgr.GetFieldIndexer().IndexField(ctx, SecretMeta(), nsIndex, indexNamespace)
+	if err != nil {
+		return nil, err
+	}
+	go func() {
+		<-ctx.Done()
+		n.queue.ShutDown()
+	}()
 	if number < minWorkNumber {
 		number = minWorkNumber
 	}
-	for i := 0; i < number; i++ {
-		go n.processWork()
+	n.sched, err = util.NewScheduler(util.SchedulerParameters{
+		Name:        "kmerge",
+		MinInterval: time.Second * 1,
+		Workers:     number,
+		Func:        n.run,
+	})
+	if err != nil {
+		return nil, err
 	}
-	err := n.probe(mgr)
+	go n.processRetry()
+	go n.processResync()
+	go n.processWork()
+	err = n.probe(mgr)
 	if err != nil {
 		return nil, err
 	}
@@ -72,130 +203,179 @@ func NewSecret(mgr ctrl.Manager, ctx context.Context, number int) (*manager, err
 	return n, err
 }
 
+// probe watches the metadata of secrets only, the data is read by fetch
+// for the secrets taking part in merges.
 func (n *manager) probe(mgr ctrl.Manager) error {
 	return ctrl.NewControllerManagedBy(mgr).
-		For(&corev1.Secret{}).
+		For(&corev1.Secret{}, builder.OnlyMetadata, builder.WithPredicates(secretPredicate())).
 		Complete(n)
 }
 
 func (n *manager) processWork() {
 	for {
-		select {
-		case ev, ok := <-n.ch:
-			if !ok {
-				return
-			}
-			n.mu.RLock()
-			se, ok := n.data[ev]
-			if !ok {
-				n.mu.RUnlock()
-				continue
-			}
-			trigger := se.t
-			n.mu.RUnlock()
-			trigger.Trigger()
-
-		case <-n.ctx.Done():
+		item, shutdown := n.queue.Get()
+		if shutdown {
 			return
 		}
+		n.dispatch(item.(string))
+		n.queue.Done(item)
 	}
 }
 
-func (n *manager) pushrsc(name string, nsname types.NamespacedName) {
+// dispatch schedules the merge of the primary.
+func (n *manager) dispatch(key string) {
 	n.mu.RLock()
-	defer n.mu.RUnlock()
+	se, ok := n.data[key]
+	scheduled := ok && se.scheduled
+	var window util.Window
+	if ok {
+		window = se.window
+	}
+	n.mu.RUnlock()
+	if !scheduled || !n.work.enqueue(key) {
+		return
+	}
+	n.sched.Schedule(key, window)
+}
 
-	for k, v := range n.data {
-		if name != "" && v.name != name {
-			continue
-		}
-		if v.fromns.Size() == 0 || v.fromns.Contains(nsname.Namespace) {
-			n.ch <- k
-			continue
-		}
+// push enqueues the primaries, it never blocks. It must not be called with
+// the lock held, so the lock is never held across queue operations.
+func (n *manager) push(keys ...string) {
+	for _, k := range keys {
+		n.queue.Add(k)
+	}
+}
+
+// removePrimary stops tracking the primary, the caller holds the lock.
+func (n *manager) removePrimary(nsname string) {
+	info, ok := n.data[nsname]
+	if !ok {
+		return
+	}
+	n.deps.removePrimary(info)
+	if info.scheduled {
+		n.sched.Remove(nsname)
+	}
+	n.failRemerges(nsname, ErrPrimaryNotFound)
+	delete(n.data, nsname)
+}
+
+// updateSource records the group name of the source, and returns the primaries
+// merging it before and after the change. The caller holds the lock.
+func (n *manager) updateSource(nsname types.NamespacedName, name string) []string {
+	old := n.deps.setSource(nsname.String(), name)
+	keys := n.deps.primaries(name, nsname.Namespace)
+	if old != name {
+		keys = append(keys, n.deps.primaries(old, nsname.Namespace)...)
 	}
+	return keys
 }
 
 func (n *manager) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
 	var (
-		in  = &corev1.Secret{}
+		in  = SecretMeta()
 		err error
+
+		keys []string
 	)
 
 	namespaceName := req.NamespacedName
-	if err = n.Get(ctx, namespaceName, in); err != nil {
+	nsname := namespaceName.String()
+	if err = n.cache.Get(ctx, namespaceName, in); err != nil {
 		klog.Errorf(fmt.Sprintf("faild get secret %s.", namespaceName.Name))
-		n.mu.Lock()
-		defer n.mu.Unlock()
-		delete(n.data, namespaceName.String())
-		n.pushrsc("", namespaceName)
-		return ctrl.Result{}, nil
 	}
 
-	if !in.ObjectMeta.DeletionTimestamp.IsZero() {
-		n.mu.Lock()
-		defer n.mu.Unlock()
-		delete(n.data, namespaceName.String())
-		n.pushrsc(in.Annotations[pkg.KmergeNameKey], namespaceName)
-		return ctrl.Result{}, nil
+	n.mu.Lock()
+	switch {
+	case err != nil, !in.ObjectMeta.DeletionTimestamp.IsZero():
+		n.removePrimary(nsname)
+		keys = n.updateSource(namespaceName, "")
+	case !isPrimary(in.Annotations):
+		n.removePrimary(nsname)
+		keys = n.updateSource(namespaceName, in.Annotations[pkg.KmergeNameKey])
+	default:
+		klog.Infof("found primary secret %s update", nsname)
+		n.updatePrimary(nsname, in.Annotations)
+		// a primary is only merged itself
+		keys = append(n.updateSource(namespaceName, ""), nsname)
 	}
-	_, hasPrimary := in.Annotations[pkg.KmergePrimaryKey]
-	_, hasName := in.Annotations[pkg.KmergeNameKey]
+	n.mu.Unlock()
 
-	if !hasName || !hasPrimary {
-		n.pushrsc(in.Annotations[pkg.KmergeNameKey], namespaceName)
-		return ctrl.Result{}, nil
-	}
-	nsname := namespaceName.String()
-	n.mu.Lock()
-	defer n.mu.Unlock()
-	klog.Infof("found primary secret %s update", nsname)
+	n.push(keys...)
+	return ctrl.Result{}, nil
+}
 
+// updatePrimary tracks the primary with the annotations, the caller holds the
+// lock.
+func (n *manager) updatePrimary(nsname string, annotations map[string]string) {
 	info, ok := n.data[nsname]
-	if !ok {
-		info = new(res)
-		info.fromns = hashset.New()
-		info.primary = nsname
-		info.name = in.Annotations[pkg.KmergeNameKey]
-		info.k = pkg.Textk
+	if ok {
+		n.deps.removePrimary(info)
+	} else {
+		info = newRes(nsname)
 		n.data[nsname] = info
 	}
-	trig, err := util.NewTrigger(util.Parameters{
-		Name:        nsname,
-		MinInterval: time.Second * 1,
-		TriggerFunc: func() {
-			n.handle(nsname)
-		},
-	})
-	if err != nil {
-		klog.Errorf("prepare trigger %s failed: %v", namespaceName, err)
-		return ctrl.Result{}, nil
+	info.parse(annotations)
+	n.deps.addPrimary(info)
+
+	owned := n.owns(nsname)
+	if !owned && info.scheduled {
+		n.sched.Remove(nsname)
+		n.failRemerges(nsname, ErrPrimaryNotOwned)
 	}
-	info.t = trig
+	info.scheduled = owned
+}
 
-	info.name = in.Annotations[pkg.KmergeNameKey]
-	fromns, ok := in.Annotations[pkg.KmergeFromNsKey]
-	if ok {
-		fns := strings.Split(fromns, ",")
-		for _, v := range fns {
-			info.fromns.Add(strings.TrimSpace(v))
-		}
+func (n *manager) owns(nsname string) bool {
+	return n.sharder == nil || n.sharder.Owns(nsname)
+}
+
+// run merges the primary, it is called by the scheduler. The remerges
+// waiting when it starts get the result.
+func (n *manager) run(nsname string) {
+	waiters := n.takeRemerges(nsname)
+	if len(waiters) == 0 && n.isPaused(nsname) {
+		klog.V(2).Infof("secret %s is paused, skip merge", nsname)
+		return
 	}
-	kind := in.Annotations[pkg.KmergeTypeKey]
-	if kind != "" {
-		k, ok := pkg.ValidKind(kind)
-		if ok {
-			info.k = k
+	err := errStopped
+	if n.work.begin(nsname) {
+		err = n.merge(nsname)
+		n.work.end(nsname)
+	}
+	for _, w := range waiters {
+		w <- err
+	}
+}
+
+// Rebalance schedules the primaries this replica owns now, and forgets the
+// ones moved to others. It is called when members changed.
+func (n *manager) Rebalance() {
+	var added []string
+	n.mu.Lock()
+	for k, v := range n.data {
+		owned := n.owns(k)
+		switch {
+		case owned && !v.scheduled:
+			added = append(added, k)
+		case !owned && v.scheduled:
+			n.sched.Remove(k)
+			n.failRemerges(k, ErrPrimaryNotOwned)
 		}
+		v.scheduled = owned
 	}
-	n.ch <- namespaceName.String()
-	return ctrl.Result{}, nil
+	n.mu.Unlock()
+
+	klog.Infof("rebalance primaries, %d added", len(added))
+	n.push(added...)
 }
 
-func (n *manager) handle(namespaceName string) {
+// handle merges the sources into the primary, a returned error means the
+// merge should be retried.
+func (n *manager) handle(namespaceName string) error {
 	name := strings.Split(namespaceName, string(types.Separator))
 	if len(name) != 2 {
-		return
+		return nil
 	}
 	klog.Infof("start handle secret %s", namespaceName)
 
@@ -204,56 +384,104 @@ func (n *manager) handle(namespaceName string) {
 			Name:      name[1],
 			Namespace: name[0],
 		}
-		in        = &corev1.Secret{}
-		mergelist = &corev1.SecretList{}
+		in *corev1.Secret
 
 		infos seInfos
+		w     written
 		err   error
 	)
 
-	if err = n.Get(n.ctx, nsname, in); err != nil {
+	// the cache may be stale after a conflict
+	in, err = n.readPrimary(nsname, n.retry.takeRefresh(namespaceName))
+	if err != nil {
 		klog.Errorf(fmt.Sprintf("inmegerd, faild get secret(%s): %v", nsname, err))
-		return
+		if !apierrors.IsNotFound(err) {
+			n.notify(namespaceName, n.getInfo(namespaceName), nil, w, err)
+		}
+		return client.IgnoreNotFound(err)
 	}
 	se := n.getInfo(namespaceName)
 	if se == nil {
-		return
+		return nil
 	}
 	klog.V(2).Infof("secret %s info %+v", namespaceName, se)
+	infos, err = n.sources(se)
+	if err != nil {
+		klog.Errorf("inmegerd, faild list secret: %v", err)
+		n.notify(namespaceName, se, nil, w, err)
+		return err
+	}
+	klog.V(2).Infof("merge list :%v", infos)
+	if se.dryRun {
+		w, err = n.previewSecret(infos, in, se)
+	} else {
+		w, err = n.updateSecret(infos, in, se)
+	}
+	klog.Infof("update secret %s, msg: %v", se.primary, err)
+	n.notify(namespaceName, se, infos, w, err)
+	return err
+}
+
+// readPrimary reads the primary through fetch, or from apiserver if refresh.
+func (n *manager) readPrimary(nsname types.NamespacedName, refresh bool) (*corev1.Secret, error) {
+	meta := SecretMeta()
+	if err := n.cache.Get(n.ctx, nsname, meta); err != nil {
+		return nil, err
+	}
+	if !refresh {
+		return n.fetch(n.ctx, meta)
+	}
+	in := &corev1.Secret{}
+	if err := n.reader.Get(n.ctx, nsname, in); err != nil {
+		return nil, err
+	}
+	return in, nil
+}
+
+// sources returns the secrets merged into the primary, in merge order. The
+// sources are found in the metadata cache, and read fully by fetch.
+func (n *manager) sources(se *res) (seInfos, error) {
+	var (
+		metas []metav1.PartialObjectMetadata
+		infos seInfos
+	)
 	if se.fromns == nil || se.fromns.Size() == 0 {
-		err = n.List(n.ctx, mergelist)
+		list := newSecretMetaList()
+		err := n.cache.List(n.ctx, list, client.MatchingFields{nameIndex: se.name})
 		if err != nil {
-			klog.Errorf("inmegerd, faild list secret: %v", err)
-			return
+			return nil, err
 		}
-		infos = append(infos, filter(mergelist, se)...)
+		metas = list.Items
 	} else {
 		for _, v := range se.fromns.Values() {
 			ns := v.(string)
-			err = n.List(n.ctx, mergelist, &client.ListOptions{Namespace: ns})
+			if n.namespaces != nil && !n.namespaces.Has(ns) {
+				klog.V(2).Infof("namespace %s of secret %s is not watched, skip", ns, se.primary)
+				continue
+			}
+			list := newSecretMetaList()
+			err := n.cache.List(n.ctx, list, client.MatchingFields{nsIndex: ns})
 			if err != nil {
-				klog.Errorf("inmegerd, faild list secret: %v", err)
-				return
+				return nil, err
 			}
-			infos = append(infos, filter(mergelist, se)...)
-			clear(mergelist.Items)
+			metas = append(metas, list.Items...)
 		}
 	}
-	klog.V(2).Infof("merge list :%v", infos)
-	sort.Sort(infos)
-	err = n.updateSecret(infos, in, func(s [][]byte) ([]byte, error) {
-		switch se.k {
-		case pkg.Textk:
-			return TextMerge(s)
-		case pkg.Jsonk:
-			return JsonMerge(s)
-		case pkg.Yamlk:
-			return YamlMerge(s)
-		default:
-			return nil, fmt.Errorf("not support")
+	for i := range metas {
+		if !isSource(&metas[i], se) {
+			continue
 		}
-	})
-	klog.Infof("update secret %s, msg: %v", se.primary, err)
+		full, err := n.fetch(n.ctx, &metas[i])
+		if apierrors.IsNotFound(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		infos = append(infos, seInfo{Secret: full})
+	}
+	sort.Sort(infos)
+	return infos, nil
 }
 
 func (n *manager) getInfo(namespaceName string) *res {
@@ -264,13 +492,24 @@ func (n *manager) getInfo(namespaceName string) *res {
 		return nil
 	}
 	return &res{
-		name:    v.name,
-		primary: v.primary,
-		fromns:  hashset.New(v.fromns.Values()...),
-		k:       v.k,
+		name:        v.name,
+		primary:     v.primary,
+		fromns:      hashset.New(v.fromns.Values()...),
+		k:           v.k,
+		dryRun:      v.dryRun,
+		rollout:     v.rollout,
+		skipInvalid: v.skipInvalid,
 	}
 }
 
+// isSource returns whether obj is merged into the primary of rs.
+func isSource(obj metav1.Object, rs *res) bool {
+	if fmt.Sprintf("%s/%s", obj.GetNamespace(), obj.GetName()) == rs.primary {
+		return false
+	}
+	return obj.GetAnnotations()[pkg.KmergeNameKey] == rs.name
+}
+
 func filter(ls *corev1.SecretList, rs *res) seInfos {
 	if ls == nil || rs == nil {
 		return nil
@@ -279,11 +518,7 @@ func filter(ls *corev1.SecretList, rs *res) seInfos {
 		ses seInfos
 	)
 	for _, se := range ls.Items {
-		nsname := fmt.Sprintf("%s/%s", se.GetNamespace(), se.GetName())
-		if nsname == rs.primary {
-			continue
-		}
-		if se.Annotations[pkg.KmergeNameKey] != rs.name {
+		if !isSource(&se, rs) {
 			continue
 		}
 		ses = append(ses, seInfo{
@@ -293,61 +528,132 @@ func filter(ls *corev1.SecretList, rs *res) seInfos {
 	return ses
 }
 
-func (m *manager) updateSecret(infos seInfos, in *corev1.Secret, fn Mergefn) error {
-	var (
-		values = map[string]*bytes.Buffer{}
+func (m *manager) updateSecret(infos seInfos, in *corev1.Secret, se *res) (written, error) {
+	w := written{}
+	if in == nil {
+		return w, nil
+	}
+	w.old = in.Annotations[pkg.KmergeHashKey]
+	inCopy, sum, err := render(infos, in, se)
+	if err != nil {
+		return w, err
+	}
+	w.sum = sum
+	if inSync(in, inCopy, sum) {
+		return w, nil
+	}
+	if legacySum(in, inCopy) {
+		klog.Infof("secret %s/%s has a legacy hash, rewrite it", in.Namespace, in.Name)
+	}
+	if err = m.adoptFields(in); err != nil {
+		return w, err
+	}
+	err = m.applySecret(applyConfig(inCopy, sum))
+	if isFieldConflict(err) {
+		m.recorder.Eventf(in, corev1.EventTypeWarning, ReasonFieldConflict, "%v", err)
+	}
+	if err != nil {
+		return w, err
+	}
+	w.changed = true
+	m.recordSkipped(in, inCopy, se)
+	if se.rollout && !sameData(in.Data, inCopy.Data) {
+		m.rollout(in, sum)
+	}
+	return w, nil
+}
+
+// applyConfig returns the fields kmerge owns on the primary, which are the
+// merged keys and the status annotations.
+func applyConfig(merged *corev1.Secret, sum string) *corev1.Secret {
+	return &corev1.Secret{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: corev1.SchemeGroupVersion.String(),
+			Kind:       "Secret",
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        merged.Name,
+			Namespace:   merged.Namespace,
+			Annotations: statusOf(merged, sum),
+		},
+		Data: merged.Data,
+	}
+}
 
-		key = util.NewPrioStringList()
+// statusOf returns the status annotations of the merge.
+func statusOf(merged *corev1.Secret, sum string) map[string]string {
+	status := map[string]string{pkg.KmergeHashKey: sum}
+	if v := merged.Annotations[pkg.KmergeSkippedKey]; v != "" {
+		status[pkg.KmergeSkippedKey] = v
+	}
+	return status
+}
 
-		hash = md5.New()
+// recordSkipped records the sources skipped by the merge of in.
+func (m *manager) recordSkipped(in, merged *corev1.Secret, se *res) {
+	if v := merged.Annotations[pkg.KmergeSkippedKey]; v != "" {
+		m.recorder.Eventf(in, corev1.EventTypeWarning, ReasonSkippedInvalid, "skip sources which are not valid %s: %s", se.k, v)
+	}
+}
 
-		vs = [][]byte{}
-	)
+// applySecret server-side applies obj as FieldManager. Ownership is never
+// forced, a conflict with other managers is returned without retry.
+func (m *manager) applySecret(obj *corev1.Secret, opts ...client.PatchOption) error {
+	opts = append(opts, client.FieldOwner(FieldManager))
+	return util.Backoff(func() error {
+		err := m.Client.Patch(m.ctx, obj, client.Apply, opts...)
+		if isFieldConflict(err) {
+			return backoff.Permanent(fmt.Errorf("fields of %s/%s are owned by other managers, release them to let %s merge: %w",
+				obj.Namespace, obj.Name, FieldManager, err))
+		}
+		return err
+	})
+}
+
+// previewSecret writes the merge result into the preview secret of the
+// primary, and patches the primary by server-side dry-run to catch
+// admission errors.
+func (m *manager) previewSecret(infos seInfos, in *corev1.Secret, se *res) (written, error) {
+	w := written{}
 	if in == nil {
-		return nil
+		return w, nil
 	}
-	inCopy := in.DeepCopy()
-	for k := range inCopy.Data {
-		values[k] = util.GetBuf()
-		key.Push(k)
+	inCopy, sum, err := render(infos, in, se)
+	if err != nil {
+		return w, err
 	}
+	w.sum = sum
 
-	for k, buf := range values {
-		clear(vs)
-		for _, se := range infos {
-			v, ok := se.Data[k]
-			if ok {
-				vs = append(vs, v)
-			}
-		}
-		v, err := fn(vs)
-		if err != nil {
-			return err
-		}
-		buf.Write(v)
+	preview := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      in.Name + pkg.KmergePreviewSuffix,
+			Namespace: in.Namespace,
+		},
 	}
-	for {
-		v, ok := key.Pop()
-		if !ok {
-			break
-		}
-		buf, ok := values[v.(string)]
-		if !ok {
-			continue
-		}
-		len, err := hash.Write(buf.Bytes())
-		if err != nil || len != buf.Len() {
-			return fmt.Errorf("copy fail, msg: %v", err)
-		}
-		inCopy.Data[v.(string)] = buf.Bytes()
-		util.PutBuf(buf)
+	err = m.Get(m.ctx, client.ObjectKeyFromObject(preview), preview)
+	if err != nil && !apierrors.IsNotFound(err) {
+		return w, err
 	}
-	sum := hex.EncodeToString(hash.Sum(nil))
-	if inCopy.Annotations[pkg.KmergeHashKey] == sum {
-		return nil
+	w.old = preview.Annotations[pkg.KmergeHashKey]
+	if err == nil && w.old == sum {
+		return w, nil
 	}
-	inCopy.Annotations[pkg.KmergeHashKey] = sum
-	return util.Backoff(func() error {
-		return m.Client.Patch(m.ctx, inCopy, client.MergeFrom(in))
+
+	err = m.applySecret(applyConfig(inCopy, sum), client.DryRunAll)
+	if err != nil {
+		return w, fmt.Errorf("dry-run patch failed: %v", err)
+	}
+
+	_, err = controllerutil.CreateOrUpdate(m.ctx, m.Client, preview, func() error {
+		// no kmerge annotations, so it is neither a primary nor a source
+		preview.Annotations = statusOf(inCopy, sum)
+		preview.Type = in.Type
+		preview.Data = inCopy.Data
+		return controllerutil.SetOwnerReference(in, preview, m.Scheme())
 	})
+	if err == nil {
+		w.changed = true
+		m.recordSkipped(in, inCopy, se)
+	}
+	return w, err
 }
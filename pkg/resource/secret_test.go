@@ -0,0 +1,305 @@
+// Copyright 2023 Authors of kmerge
+// SPDX-License-Identifier: Apache-2.0
+
+package resource
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/yylt/kmerge/pkg"
+	"github.com/yylt/kmerge/pkg/notify"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/interceptor"
+)
+
+func TestHandleDryRun(t *testing.T) {
+	annotations := map[string]string{
+		pkg.KmergePrimaryKey: "",
+		pkg.KmergeNameKey:    "group",
+		pkg.KmergeModeKey:    pkg.DryRunMode,
+	}
+	primary := newTestSecret("p", "primary", annotations, map[string]string{"k": "old"})
+	primary.UID = "uid"
+	n := newTestManager(
+		primary,
+		newTestSecret("a", "src", map[string]string{pkg.KmergeNameKey: "group"}, map[string]string{"k": "new"}),
+	)
+	info := newRes("p/primary")
+	info.parse(annotations)
+	n.data["p/primary"] = info
+
+	assert.NoError(t, n.handle("p/primary"))
+
+	got := &corev1.Secret{}
+	assert.NoError(t, n.Get(n.ctx, types.NamespacedName{Namespace: "p", Name: "primary"}, got))
+	assert.Equal(t, "old", string(got.Data["k"]))
+	assert.Empty(t, got.Annotations[pkg.KmergeHashKey])
+
+	preview := &corev1.Secret{}
+	assert.NoError(t, n.Get(n.ctx, types.NamespacedName{Namespace: "p", Name: "primary" + pkg.KmergePreviewSuffix}, preview))
+	assert.Equal(t, "new", string(preview.Data["k"]))
+	assert.NotEmpty(t, preview.Annotations[pkg.KmergeHashKey])
+	assert.Empty(t, preview.Annotations[pkg.KmergeNameKey])
+	assert.Len(t, preview.OwnerReferences, 1)
+}
+
+func TestHandleApply(t *testing.T) {
+	annotations := map[string]string{
+		pkg.KmergePrimaryKey: "",
+		pkg.KmergeNameKey:    "group",
+	}
+	n := newTestManager(
+		newTestSecret("p", "primary", annotations, map[string]string{"k": "old"}),
+		newTestSecret("a", "src", map[string]string{pkg.KmergeNameKey: "group"}, map[string]string{"k": "new"}),
+	)
+	info := newRes("p/primary")
+	info.parse(annotations)
+	n.data["p/primary"] = info
+
+	assert.NoError(t, n.handle("p/primary"))
+
+	got := &corev1.Secret{}
+	assert.NoError(t, n.Get(n.ctx, types.NamespacedName{Namespace: "p", Name: "primary"}, got))
+	assert.Equal(t, "new", string(got.Data["k"]))
+	assert.NotEmpty(t, got.Annotations[pkg.KmergeHashKey])
+	// annotations of other managers are kept
+	assert.Equal(t, "group", got.Annotations[pkg.KmergeNameKey])
+}
+
+func TestReconcileStress(t *testing.T) {
+	const (
+		groups  = 5
+		workers = 20
+		events  = 250
+	)
+	var objs []client.Object
+	for i := 0; i < groups; i++ {
+		annotations := map[string]string{pkg.KmergePrimaryKey: "", pkg.KmergeNameKey: fmt.Sprintf("g%d", i)}
+		if i%2 == 1 {
+			annotations[pkg.KmergeFromNsKey] = fmt.Sprintf("ns%d", i)
+		}
+		objs = append(objs, newTestSecret("p", fmt.Sprintf("primary%d", i), annotations, map[string]string{"k": ""}))
+	}
+	n := newTestManager(objs...)
+	ctx, cancel := context.WithCancel(context.Background())
+	n.ctx = ctx
+	defer func() {
+		n.Drain(ctx)
+		cancel()
+	}()
+	go n.processWork()
+
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			rnd := rand.New(rand.NewSource(int64(w)))
+			ns := fmt.Sprintf("ns%d", w%groups)
+			for i := 0; i < events; i++ {
+				name := fmt.Sprintf("src%d-%d", w, i%10)
+				key := types.NamespacedName{Namespace: ns, Name: name}
+				se := newTestSecret(ns, name, map[string]string{pkg.KmergeNameKey: fmt.Sprintf("g%d", rnd.Intn(groups))}, map[string]string{"k": name})
+				switch rnd.Intn(3) {
+				case 0:
+					_ = n.Delete(ctx, se)
+				default:
+					if err := n.Create(ctx, se); apierrors.IsAlreadyExists(err) {
+						cur := &corev1.Secret{}
+						assert.NoError(t, n.Get(ctx, key, cur))
+						cur.Annotations = se.Annotations
+						assert.NoError(t, n.Update(ctx, cur))
+					}
+				}
+				_, err := n.Reconcile(ctx, ctrl.Request{NamespacedName: key})
+				assert.NoError(t, err)
+				if i%25 == 0 {
+					primary := types.NamespacedName{Namespace: "p", Name: fmt.Sprintf("primary%d", rnd.Intn(groups))}
+					_, err = n.Reconcile(ctx, ctrl.Request{NamespacedName: primary})
+					assert.NoError(t, err)
+				}
+			}
+		}(w)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Minute):
+		t.Fatal("reconcile stalled")
+	}
+	assert.Eventually(t, func() bool { return n.queue.Len() == 0 }, 10*time.Second, 10*time.Millisecond)
+
+	// the reverse index matches the sources left
+	list := &corev1.SecretList{}
+	assert.NoError(t, n.List(ctx, list))
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	assert.Len(t, n.data, groups)
+	sources := 0
+	for _, se := range list.Items {
+		if isPrimary(se.Annotations) {
+			continue
+		}
+		sources++
+		assert.Equal(t, se.Annotations[pkg.KmergeNameKey], n.deps.sources[se.Namespace+"/"+se.Name])
+	}
+	assert.Len(t, n.deps.sources, sources)
+}
+
+type testNotifier struct {
+	events []notify.Event
+}
+
+func (t *testNotifier) Notify(ev notify.Event) {
+	t.events = append(t.events, ev)
+}
+
+func TestHandleNotify(t *testing.T) {
+	annotations := map[string]string{
+		pkg.KmergePrimaryKey: "",
+		pkg.KmergeNameKey:    "group",
+		pkg.KmergeTypeKey:    "json",
+	}
+	n := newTestManager(
+		newTestSecret("p", "primary", annotations, map[string]string{"k": "{}"}),
+		newTestSecret("a", "src", map[string]string{pkg.KmergeNameKey: "group"}, map[string]string{"k": `{"a":1}`}),
+	)
+	nf := &testNotifier{}
+	n.notifier = nf
+	info := newRes("p/primary")
+	info.parse(annotations)
+	n.data["p/primary"] = info
+
+	assert.NoError(t, n.handle("p/primary"))
+	assert.NoError(t, n.handle("p/primary"))
+	assert.Len(t, nf.events, 2)
+	changed, unchanged := nf.events[0], nf.events[1]
+	assert.Equal(t, notify.Changed, changed.Result)
+	assert.Equal(t, "p/primary", changed.Primary)
+	assert.Equal(t, []string{"a/src"}, changed.Sources)
+	assert.Empty(t, changed.OldHash)
+	assert.NotEmpty(t, changed.NewHash)
+	assert.Equal(t, notify.Unchanged, unchanged.Result)
+	assert.Equal(t, changed.NewHash, unchanged.OldHash)
+	assert.Equal(t, changed.NewHash, unchanged.NewHash)
+
+	// an invalid source fails the merge
+	src := &corev1.Secret{}
+	assert.NoError(t, n.Get(n.ctx, types.NamespacedName{Namespace: "a", Name: "src"}, src))
+	src.Data["k"] = []byte(`{"a":`)
+	assert.NoError(t, n.Update(n.ctx, src))
+	assert.Error(t, n.handle("p/primary"))
+	assert.Len(t, nf.events, 3)
+	assert.Equal(t, notify.Failed, nf.events[2].Result)
+	assert.NotEmpty(t, nf.events[2].Error)
+}
+
+func TestHandleSkipInvalid(t *testing.T) {
+	annotations := map[string]string{
+		pkg.KmergePrimaryKey: "",
+		pkg.KmergeNameKey:    "group",
+		pkg.KmergeTypeKey:    "json",
+		pkg.KmergePolicyKey:  pkg.SkipInvalidPolicy,
+	}
+	n := newTestManager(
+		newTestSecret("p", "primary", annotations, map[string]string{"k": "{}"}),
+		newTestSecret("a", "src", map[string]string{pkg.KmergeNameKey: "group"}, map[string]string{"k": `{"a":1}`}),
+		newTestSecret("b", "src", map[string]string{pkg.KmergeNameKey: "group"}, map[string]string{"k": `{"b":`}),
+	)
+	recorder := n.recorder.(*record.FakeRecorder)
+	info := newRes("p/primary")
+	info.parse(annotations)
+	n.data["p/primary"] = info
+
+	assert.NoError(t, n.handle("p/primary"))
+	key := types.NamespacedName{Namespace: "p", Name: "primary"}
+	got := &corev1.Secret{}
+	assert.NoError(t, n.Get(n.ctx, key, got))
+	assert.JSONEq(t, `{"a":1}`, string(got.Data["k"]))
+	assert.Equal(t, "b/src", got.Annotations[pkg.KmergeSkippedKey])
+	event := <-recorder.Events
+	assert.Contains(t, event, ReasonSkippedInvalid)
+	assert.Contains(t, event, "b/src")
+
+	// the fixed source is merged, and the annotation is released by apply,
+	// which the fake client does not remove
+	src := &corev1.Secret{}
+	assert.NoError(t, n.Get(n.ctx, types.NamespacedName{Namespace: "b", Name: "src"}, src))
+	src.Data["k"] = []byte(`{"b":1}`)
+	assert.NoError(t, n.Update(n.ctx, src))
+	assert.NoError(t, n.handle("p/primary"))
+	assert.NoError(t, n.Get(n.ctx, key, got))
+	assert.JSONEq(t, `{"a":1,"b":1}`, string(got.Data["k"]))
+	infos, err := n.sources(info)
+	assert.NoError(t, err)
+	out, sum, err := render(infos, got, info)
+	assert.NoError(t, err)
+	assert.NotContains(t, applyConfig(out, sum).Annotations, pkg.KmergeSkippedKey)
+	assert.Empty(t, recorder.Events)
+}
+
+func TestDispatchDebounce(t *testing.T) {
+	annotations := map[string]string{
+		pkg.KmergePrimaryKey:  "",
+		pkg.KmergeNameKey:     "group",
+		pkg.KmergeDebounceKey: "1h",
+	}
+	n := newTestManager()
+	info := newRes("p/primary")
+	info.parse(annotations)
+	info.scheduled = true
+	n.data["p/primary"] = info
+
+	// the merge waits in the scheduler for the debounce of the primary
+	n.dispatch("p/primary")
+	n.dispatch("p/primary")
+	assert.Equal(t, 1, n.sched.Pending())
+	assert.Equal(t, StateQueued, n.Primaries()[0].State)
+}
+
+func TestHandleFieldConflict(t *testing.T) {
+	annotations := map[string]string{
+		pkg.KmergePrimaryKey: "",
+		pkg.KmergeNameKey:    "group",
+	}
+	n := newTestManager(
+		newTestSecret("p", "primary", annotations, map[string]string{"k": "old"}),
+		newTestSecret("a", "src", map[string]string{pkg.KmergeNameKey: "group"}, map[string]string{"k": "new"}),
+	)
+	n.Client = interceptor.NewClient(n.Client.(client.WithWatch), interceptor.Funcs{
+		Patch: func(ctx context.Context, c client.WithWatch, obj client.Object, patch client.Patch, opts ...client.PatchOption) error {
+			if patch.Type() == types.ApplyPatchType {
+				return newFieldConflict(obj.GetName())
+			}
+			return c.Patch(ctx, obj, patch, opts...)
+		},
+	})
+	recorder := n.recorder.(*record.FakeRecorder)
+	info := newRes("p/primary")
+	info.parse(annotations)
+	n.data["p/primary"] = info
+
+	// reported on the primary instead of retried
+	err := n.merge("p/primary")
+	assert.True(t, isFieldConflict(err))
+	assert.Equal(t, 0, n.retry.queue.NumRequeues("p/primary"))
+	event := <-recorder.Events
+	assert.Contains(t, event, ReasonFieldConflict)
+	assert.Contains(t, event, "kubectl-edit")
+}
@@ -0,0 +1,271 @@
+// Copyright 2023 Authors of kmerge
+// SPDX-License-Identifier: Apache-2.0
+
+package resource
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/yylt/kmerge/pkg"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// knownAnnotations are the kmerge annotations, others are reported as
+// unknown.
+var knownAnnotations = []string{
+	pkg.KmergeTypeKey,
+	pkg.KmergePrimaryKey,
+	pkg.KmergeNameKey,
+	pkg.KmergeFromNsKey,
+	pkg.KmergeToNsKey,
+	pkg.KmergeHashKey,
+	pkg.KmergeModeKey,
+	pkg.KmergeDebounceKey,
+	pkg.KmergeMaxWaitKey,
+	pkg.KmergeRolloutKey,
+	pkg.KmergePolicyKey,
+	pkg.KmergeSkippedKey,
+}
+
+// primaryAnnotations only apply to primaries.
+var primaryAnnotations = []string{
+	pkg.KmergeFromNsKey,
+	pkg.KmergeModeKey,
+	pkg.KmergeDebounceKey,
+	pkg.KmergeMaxWaitKey,
+	pkg.KmergeRolloutKey,
+	pkg.KmergePolicyKey,
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// Validate checks the kmerge annotations of obj, which is a Secret or a
+// ConfigMap kept as a Secret. The primaries of the group are listed from
+// cache and read from reader, to check the data of sources in structured
+// groups and primaries merged into other primaries, a nil cache skips them.
+// It returns the problems which are ignored by merges as warnings, and the
+// others as error.
+func Validate(ctx context.Context, cache, reader client.Reader, obj *corev1.Secret) ([]string, error) {
+	var (
+		warnings []string
+		errs     []string
+
+		annotations = obj.Annotations
+		primary     = isPrimary(annotations)
+	)
+	keys := make([]string, 0, len(annotations))
+	for k := range annotations {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		if !isKmergeKey(k) {
+			continue
+		}
+		if !contains(knownAnnotations, k) {
+			warnings = append(warnings, fmt.Sprintf("unknown annotation %s is ignored", k))
+			continue
+		}
+		if !primary && contains(primaryAnnotations, k) {
+			warnings = append(warnings, fmt.Sprintf("annotation %s only applies to primaries, it is ignored", k))
+		}
+		if err := validateAnnotation(k, annotations[k]); err != nil {
+			errs = append(errs, fmt.Sprintf("annotation %s: %v", k, err))
+		}
+	}
+	_, hasPrimary := annotations[pkg.KmergePrimaryKey]
+	if _, ok := annotations[pkg.KmergeNameKey]; hasPrimary && !ok {
+		errs = append(errs, fmt.Sprintf("primary requires annotation %s", pkg.KmergeNameKey))
+	}
+	if _, ok := annotations[pkg.KmergeMaxWaitKey]; ok && annotations[pkg.KmergeDebounceKey] == "" {
+		warnings = append(warnings, fmt.Sprintf("annotation %s is ignored without %s", pkg.KmergeMaxWaitKey, pkg.KmergeDebounceKey))
+	}
+
+	// a source declaring a structured type must hold it
+	if k, ok := pkg.ValidKind(annotations[pkg.KmergeTypeKey]); ok && !primary {
+		errs = append(errs, checkData(obj, k, obj.Data, "")...)
+	}
+	if cache != nil && annotations[pkg.KmergeNameKey] != "" {
+		groupErrs, groupWarnings, err := validateGroup(ctx, cache, reader, obj, primary)
+		if err != nil {
+			warnings = append(warnings, fmt.Sprintf("group %s is not checked: %v", annotations[pkg.KmergeNameKey], err))
+		}
+		errs = append(errs, groupErrs...)
+		warnings = append(warnings, groupWarnings...)
+	}
+	if len(errs) > 0 {
+		return warnings, errors.New(strings.Join(errs, "; "))
+	}
+	return warnings, nil
+}
+
+// ValidateUpdate validates obj updated from old. If the update changed
+// neither the kmerge annotations nor the data of a source, the problems are
+// only warned, they were admitted before, e.g. the webhook was not installed,
+// and other writes of the secret, kmerge's included, must not be denied.
+func ValidateUpdate(ctx context.Context, cache, reader client.Reader, old, obj *corev1.Secret) ([]string, error) {
+	warnings, err := Validate(ctx, cache, reader, obj)
+	if err == nil || kmergeChanged(old, obj) {
+		return warnings, err
+	}
+	return append(warnings, fmt.Sprintf("kmerge annotations are not changed, they are invalid: %v", err)), nil
+}
+
+// kmergeChanged returns whether the update changed the kmerge annotations
+// other than the status ones, or the data of a source.
+func kmergeChanged(old, obj *corev1.Secret) bool {
+	if !reflect.DeepEqual(mergeAnnotations(old), mergeAnnotations(obj)) {
+		return true
+	}
+	return !isPrimary(obj.Annotations) && !sameData(old.Data, obj.Data)
+}
+
+// mergeAnnotations returns the kmerge annotations of obj other than the
+// status ones.
+func mergeAnnotations(obj *corev1.Secret) map[string]string {
+	annotations := map[string]string{}
+	for k, v := range obj.Annotations {
+		if isKmergeKey(k) && !isStatusAnnotation(k) {
+			annotations[k] = v
+		}
+	}
+	return annotations
+}
+
+func validateAnnotation(k, v string) error {
+	switch k {
+	case pkg.KmergeTypeKey:
+		if _, ok := pkg.ValidKind(v); !ok {
+			return fmt.Errorf("unknown kind %q, support %s, %s and %s", v, pkg.Textk, pkg.Jsonk, pkg.Yamlk)
+		}
+	case pkg.KmergeNameKey:
+		if strings.TrimSpace(v) == "" {
+			return fmt.Errorf("must not be empty")
+		}
+	case pkg.KmergeModeKey:
+		if v != "" && v != pkg.DryRunMode {
+			return fmt.Errorf("unknown mode %q, support %s", v, pkg.DryRunMode)
+		}
+	case pkg.KmergeDebounceKey, pkg.KmergeMaxWaitKey:
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return err
+		}
+		if d < 0 {
+			return fmt.Errorf("must not be negative")
+		}
+	case pkg.KmergePolicyKey:
+		if v != pkg.StrictPolicy && v != pkg.SkipInvalidPolicy {
+			return fmt.Errorf("unknown policy %q, support %s and %s", v, pkg.StrictPolicy, pkg.SkipInvalidPolicy)
+		}
+	case pkg.KmergeRolloutKey:
+		if v != "true" && v != "false" {
+			return fmt.Errorf("must be true or false")
+		}
+	case pkg.KmergeFromNsKey, pkg.KmergeToNsKey:
+		for _, ns := range strings.Split(v, ",") {
+			ns = strings.TrimSpace(ns)
+			if ns == "" {
+				continue
+			}
+			if msgs := validation.IsDNS1123Label(ns); len(msgs) > 0 {
+				return fmt.Errorf("invalid namespace %q: %s", ns, strings.Join(msgs, ", "))
+			}
+		}
+	}
+	return nil
+}
+
+// validateGroup checks obj against the other primaries of its group. The
+// invalid data of a source is only warned for primaries skipping invalid
+// sources.
+func validateGroup(ctx context.Context, cache, reader client.Reader, obj *corev1.Secret, primary bool) ([]string, []string, error) {
+	list := newSecretMetaList()
+	err := cache.List(ctx, list, client.MatchingFields{nameIndex: obj.Annotations[pkg.KmergeNameKey]})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var (
+		errs     []string
+		warnings []string
+		self     *res
+	)
+	if primary {
+		self = newRes(fmt.Sprintf("%s/%s", obj.Namespace, obj.Name))
+		self.parse(obj.Annotations)
+	}
+	for i := range list.Items {
+		v := &list.Items[i]
+		if !isPrimary(v.Annotations) || (v.Namespace == obj.Namespace && v.Name == obj.Name) {
+			continue
+		}
+		rs := newRes(fmt.Sprintf("%s/%s", v.Namespace, v.Name))
+		rs.parse(v.Annotations)
+		covered := rs.fromns.Size() == 0 || rs.fromns.Contains(obj.Namespace)
+		switch {
+		case primary && covered:
+			errs = append(errs, fmt.Sprintf("primary is also a source of primary %s in group %s", rs.primary, rs.name))
+		case primary && (self.fromns.Size() == 0 || self.fromns.Contains(v.Namespace)):
+			errs = append(errs, fmt.Sprintf("primary %s in group %s is also a source of this primary", rs.primary, rs.name))
+		case !primary && covered && rs.k != pkg.Textk:
+			// only the keys of the primary are merged
+			in := &corev1.Secret{}
+			if err = reader.Get(ctx, client.ObjectKeyFromObject(v), in); err != nil {
+				return errs, warnings, err
+			}
+			invalid := checkData(obj, rs.k, in.Data, rs.primary)
+			if !rs.skipInvalid {
+				errs = append(errs, invalid...)
+				continue
+			}
+			for _, msg := range invalid {
+				warnings = append(warnings, msg+", the source is skipped")
+			}
+		}
+	}
+	return errs, warnings, nil
+}
+
+// checkData returns the keys of obj in merged which are not valid k, to be
+// merged into primary if not empty.
+func checkData(obj *corev1.Secret, k pkg.Kind, merged map[string][]byte, primary string) []string {
+	if k == pkg.Textk {
+		return nil
+	}
+	keys := make([]string, 0, len(obj.Data))
+	for key := range obj.Data {
+		if _, ok := merged[key]; !ok {
+			continue
+		}
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var errs []string
+	for _, key := range keys {
+		if err := parseable(k, obj.Data[key]); err != nil {
+			msg := fmt.Sprintf("key %s is not valid %s: %v", key, k, err)
+			if primary != "" {
+				msg = fmt.Sprintf("key %s is not valid %s for primary %s: %v", key, k, primary, err)
+			}
+			errs = append(errs, msg)
+		}
+	}
+	return errs
+}
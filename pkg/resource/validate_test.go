@@ -0,0 +1,153 @@
+// Copyright 2023 Authors of kmerge
+// SPDX-License-Identifier: Apache-2.0
+
+package resource
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/yylt/kmerge/pkg"
+)
+
+func TestValidateAnnotations(t *testing.T) {
+	ctx := context.Background()
+	for _, tc := range []struct {
+		name        string
+		annotations map[string]string
+		err         string
+	}{
+		{"unknown kind", map[string]string{pkg.KmergeTypeKey: "jsn"}, `unknown kind "jsn"`},
+		{"unknown mode", map[string]string{pkg.KmergePrimaryKey: "", pkg.KmergeNameKey: "g", pkg.KmergeModeKey: "dry"}, `unknown mode "dry"`},
+		{"invalid namespace", map[string]string{pkg.KmergePrimaryKey: "", pkg.KmergeNameKey: "g", pkg.KmergeFromNsKey: "a, B_c"}, `invalid namespace "B_c"`},
+		{"invalid debounce", map[string]string{pkg.KmergePrimaryKey: "", pkg.KmergeNameKey: "g", pkg.KmergeDebounceKey: "soon"}, pkg.KmergeDebounceKey},
+		{"negative max-wait", map[string]string{pkg.KmergePrimaryKey: "", pkg.KmergeNameKey: "g", pkg.KmergeDebounceKey: "1s", pkg.KmergeMaxWaitKey: "-1s"}, "negative"},
+		{"unknown policy", map[string]string{pkg.KmergePrimaryKey: "", pkg.KmergeNameKey: "g", pkg.KmergePolicyKey: "skip"}, `unknown policy "skip"`},
+		{"invalid rollout", map[string]string{pkg.KmergePrimaryKey: "", pkg.KmergeNameKey: "g", pkg.KmergeRolloutKey: "yes"}, "true or false"},
+		{"primary without name", map[string]string{pkg.KmergePrimaryKey: ""}, "requires annotation"},
+		{"empty name", map[string]string{pkg.KmergeNameKey: " "}, "must not be empty"},
+		{"valid primary", map[string]string{pkg.KmergePrimaryKey: "", pkg.KmergeNameKey: "g", pkg.KmergeTypeKey: "json", pkg.KmergeFromNsKey: "a,b"}, ""},
+	} {
+		_, err := Validate(ctx, nil, nil, newTestSecret("a", "s", tc.annotations, nil))
+		if tc.err == "" {
+			assert.NoError(t, err, tc.name)
+			continue
+		}
+		if assert.Error(t, err, tc.name) {
+			assert.Contains(t, err.Error(), tc.err, tc.name)
+		}
+	}
+
+	warnings, err := Validate(ctx, nil, nil, newTestSecret("a", "s", map[string]string{
+		pkg.KmergeNameKey:   "g",
+		pkg.KmergeFromNsKey: "b",
+		"kmerge.io/tpye":    "json",
+	}, nil))
+	assert.NoError(t, err)
+	assert.Len(t, warnings, 2)
+
+	// a source declaring its type holds it
+	_, err = Validate(ctx, nil, nil, newTestSecret("a", "s", map[string]string{
+		pkg.KmergeNameKey: "g",
+		pkg.KmergeTypeKey: "yaml",
+	}, map[string]string{"k": "a: [b"}))
+	assert.Error(t, err)
+}
+
+func TestValidateGroup(t *testing.T) {
+	ctx := context.Background()
+	primary := map[string]string{
+		pkg.KmergePrimaryKey: "",
+		pkg.KmergeNameKey:    "group",
+		pkg.KmergeTypeKey:    "json",
+		pkg.KmergeFromNsKey:  "a",
+	}
+	n := newTestManager(newTestSecret("p", "primary", primary, map[string]string{"k": "{}"}))
+	source := map[string]string{pkg.KmergeNameKey: "group"}
+
+	_, err := Validate(ctx, n.cache, n.reader, newTestSecret("a", "src", source, map[string]string{"k": `{"a":1}`}))
+	assert.NoError(t, err)
+	_, err = Validate(ctx, n.cache, n.reader, newTestSecret("a", "src", source, map[string]string{"k": `{"a":`}))
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "key k is not valid json for primary p/primary")
+	}
+	// keys not in the primary are never merged
+	_, err = Validate(ctx, n.cache, n.reader, newTestSecret("a", "src", source, map[string]string{"k": `{"a":1}`, "other": `{"a":`}))
+	assert.NoError(t, err)
+	// not merged by the primary
+	_, err = Validate(ctx, n.cache, n.reader, newTestSecret("b", "src", source, map[string]string{"k": `{"a":`}))
+	assert.NoError(t, err)
+
+	// the primary itself is valid, another primary merged into it is not
+	_, err = Validate(ctx, n.cache, n.reader, newTestSecret("p", "primary", primary, nil))
+	assert.NoError(t, err)
+	_, err = Validate(ctx, n.cache, n.reader, newTestSecret("a", "other", map[string]string{
+		pkg.KmergePrimaryKey: "",
+		pkg.KmergeNameKey:    "group",
+		pkg.KmergeFromNsKey:  "c",
+	}, nil))
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "primary is also a source of primary p/primary")
+	}
+	_, err = Validate(ctx, n.cache, n.reader, newTestSecret("c", "other", map[string]string{
+		pkg.KmergePrimaryKey: "",
+		pkg.KmergeNameKey:    "group",
+	}, nil))
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "primary p/primary in group group is also a source")
+	}
+}
+
+func TestValidateSkipInvalid(t *testing.T) {
+	ctx := context.Background()
+	primary := map[string]string{
+		pkg.KmergePrimaryKey: "",
+		pkg.KmergeNameKey:    "group",
+		pkg.KmergeTypeKey:    "json",
+		pkg.KmergePolicyKey:  pkg.SkipInvalidPolicy,
+	}
+	n := newTestManager(newTestSecret("p", "skip", primary, map[string]string{"k": "{}"}))
+	source := newTestSecret("a", "src", map[string]string{pkg.KmergeNameKey: "group"}, map[string]string{"k": `{"a":`})
+
+	// skipped by the only covering primary
+	warnings, err := Validate(ctx, n.cache, n.reader, source)
+	assert.NoError(t, err)
+	if assert.Len(t, warnings, 1) {
+		assert.Contains(t, warnings[0], "key k is not valid json for primary p/skip")
+	}
+
+	// a strict primary fails the merge
+	delete(primary, pkg.KmergePolicyKey)
+	assert.NoError(t, n.Create(ctx, newTestSecret("p", "strict", primary, map[string]string{"k": "{}"})))
+	warnings, err = Validate(ctx, n.cache, n.reader, source)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "key k is not valid json for primary p/strict")
+	}
+	assert.Len(t, warnings, 1)
+}
+
+func TestValidateUpdate(t *testing.T) {
+	ctx := context.Background()
+	old := newTestSecret("a", "src", map[string]string{
+		pkg.KmergeNameKey: "g",
+		pkg.KmergeTypeKey: "yaml",
+	}, map[string]string{"k": "a: [b"})
+
+	// unchanged kmerge annotations and data
+	obj := old.DeepCopy()
+	obj.Labels = map[string]string{"app": "a"}
+	warnings, err := ValidateUpdate(ctx, nil, nil, old, obj)
+	assert.NoError(t, err)
+	assert.Len(t, warnings, 1)
+
+	// the data of a source is checked
+	obj.Data["k"] = []byte("a: [c")
+	_, err = ValidateUpdate(ctx, nil, nil, old, obj)
+	assert.Error(t, err)
+
+	obj = old.DeepCopy()
+	obj.Annotations[pkg.KmergeTypeKey] = "json"
+	_, err = ValidateUpdate(ctx, nil, nil, old, obj)
+	assert.Error(t, err)
+}
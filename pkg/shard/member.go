@@ -0,0 +1,194 @@
+// Copyright 2023 Authors of kmerge
+// SPDX-License-Identifier: Apache-2.0
+
+package shard
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/yylt/kmerge/pkg/lock"
+	coordinationv1 "k8s.io/api/coordination/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	coordinationclient "k8s.io/client-go/kubernetes/typed/coordination/v1"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// MemberLabel marks the leases used for membership, the value is the group name.
+	MemberLabel = "kmerge.io/member"
+
+	leasePrefix = "kmerge-member-"
+)
+
+// Membership tracks the live replicas through one lease per replica, and
+// assigns keys to them with a consistent hash ring.
+type Membership struct {
+	client    coordinationclient.LeasesGetter
+	namespace string
+	group     string
+	identity  string
+
+	// a member is alive while its lease was renewed within leaseDuration
+	leaseDuration time.Duration
+	renewPeriod   time.Duration
+
+	mu       lock.RWMutex
+	ring     *Ring
+	members  []string
+	onChange []func()
+}
+
+// NewMembership returns a membership of group, the lease of this replica is
+// created in namespace and named by identity.
+func NewMembership(client coordinationclient.LeasesGetter, namespace, group, identity string, leaseDuration, renewPeriod time.Duration) (*Membership, error) {
+	if namespace == "" || group == "" || identity == "" {
+		return nil, fmt.Errorf("namespace, group and identity must not be empty")
+	}
+	if renewPeriod <= 0 || renewPeriod >= leaseDuration {
+		return nil, fmt.Errorf("renew period %v must be positive and less than lease duration %v", renewPeriod, leaseDuration)
+	}
+	return &Membership{
+		client:        client,
+		namespace:     namespace,
+		group:         group,
+		identity:      identity,
+		leaseDuration: leaseDuration,
+		renewPeriod:   renewPeriod,
+	}, nil
+}
+
+// OnChange registers fn which is called after the members changed.
+func (m *Membership) OnChange(fn func()) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.onChange = append(m.onChange, fn)
+}
+
+// Identity returns the identity of this replica.
+func (m *Membership) Identity() string {
+	return m.identity
+}
+
+// Members returns the live members, sorted by name.
+func (m *Membership) Members() []string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return append([]string(nil), m.members...)
+}
+
+// Owns returns whether key is assigned to this replica. Nothing is owned
+// before the first membership sync.
+func (m *Membership) Owns(key string) bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.ring.Owner(key) == m.identity
+}
+
+// Start renews the lease of this replica and refreshes the members until ctx
+// is done, the lease is deleted on return so others rebalance at once.
+func (m *Membership) Start(ctx context.Context) {
+	ticker := time.NewTicker(m.renewPeriod)
+	defer ticker.Stop()
+	for {
+		if err := m.sync(ctx); err != nil {
+			klog.Errorf("sync membership of %s failed: %v", m.identity, err)
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			m.release()
+			return
+		}
+	}
+}
+
+// sync renews the lease of this replica and rebuilds the ring when the live
+// members changed.
+func (m *Membership) sync(ctx context.Context) error {
+	if err := m.renew(ctx); err != nil {
+		return err
+	}
+	leases, err := m.client.Leases(m.namespace).List(ctx, metav1.ListOptions{
+		LabelSelector: fmt.Sprintf("%s=%s", MemberLabel, m.group),
+	})
+	if err != nil {
+		return err
+	}
+	var (
+		now     = time.Now()
+		members []string
+	)
+	for _, l := range leases.Items {
+		if l.Spec.HolderIdentity == nil || l.Spec.RenewTime == nil {
+			continue
+		}
+		if l.Spec.RenewTime.Add(m.leaseDuration).Before(now) {
+			continue
+		}
+		members = append(members, *l.Spec.HolderIdentity)
+	}
+	sort.Strings(members)
+
+	m.mu.Lock()
+	if strings.Join(members, ",") == strings.Join(m.members, ",") && m.ring != nil {
+		m.mu.Unlock()
+		return nil
+	}
+	klog.Infof("members of %s changed from %v to %v", m.group, m.members, members)
+	m.members = members
+	m.ring = NewRing(members, DefaultVirtualNodes)
+	fns := append([]func(){}, m.onChange...)
+	m.mu.Unlock()
+
+	for _, fn := range fns {
+		fn()
+	}
+	return nil
+}
+
+func (m *Membership) renew(ctx context.Context) error {
+	var (
+		name    = leasePrefix + m.identity
+		now     = metav1.NewMicroTime(time.Now())
+		seconds = int32(m.leaseDuration.Seconds())
+	)
+	l, err := m.client.Leases(m.namespace).Get(ctx, name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		_, err = m.client.Leases(m.namespace).Create(ctx, &coordinationv1.Lease{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      name,
+				Namespace: m.namespace,
+				Labels:    map[string]string{MemberLabel: m.group},
+			},
+			Spec: coordinationv1.LeaseSpec{
+				HolderIdentity:       &m.identity,
+				LeaseDurationSeconds: &seconds,
+				AcquireTime:          &now,
+				RenewTime:            &now,
+			},
+		}, metav1.CreateOptions{})
+		return err
+	}
+	if err != nil {
+		return err
+	}
+	l.Spec.HolderIdentity = &m.identity
+	l.Spec.LeaseDurationSeconds = &seconds
+	l.Spec.RenewTime = &now
+	_, err = m.client.Leases(m.namespace).Update(ctx, l, metav1.UpdateOptions{})
+	return err
+}
+
+func (m *Membership) release() {
+	ctx, cancel := context.WithTimeout(context.Background(), m.renewPeriod)
+	defer cancel()
+	err := m.client.Leases(m.namespace).Delete(ctx, leasePrefix+m.identity, metav1.DeleteOptions{})
+	if err != nil && !apierrors.IsNotFound(err) {
+		klog.Errorf("release lease of %s failed: %v", m.identity, err)
+	}
+}
@@ -0,0 +1,48 @@
+// Copyright 2023 Authors of kmerge
+// SPDX-License-Identifier: Apache-2.0
+
+package shard
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestMembershipSync(t *testing.T) {
+	var (
+		ctx     = context.Background()
+		client  = fake.NewSimpleClientset().CoordinationV1()
+		changed = 0
+	)
+	a, err := NewMembership(client, "kmerge", "test", "a", 15*time.Second, 2*time.Second)
+	assert.NoError(t, err)
+	b, err := NewMembership(client, "kmerge", "test", "b", 15*time.Second, 2*time.Second)
+	assert.NoError(t, err)
+	a.OnChange(func() { changed++ })
+
+	assert.False(t, a.Owns("ns/name"))
+	assert.NoError(t, a.sync(ctx))
+	assert.Equal(t, []string{"a"}, a.Members())
+	assert.True(t, a.Owns("ns/name"))
+
+	assert.NoError(t, b.sync(ctx))
+	assert.NoError(t, a.sync(ctx))
+	assert.Equal(t, []string{"a", "b"}, a.Members())
+	assert.Equal(t, 2, changed)
+
+	// every key has exactly one owner
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprintf("ns-%d/name", i)
+		assert.NotEqual(t, a.Owns(key), b.Owns(key))
+	}
+
+	b.release()
+	assert.NoError(t, a.sync(ctx))
+	assert.Equal(t, []string{"a"}, a.Members())
+	assert.Equal(t, 3, changed)
+}
@@ -0,0 +1,64 @@
+// Copyright 2023 Authors of kmerge
+// SPDX-License-Identifier: Apache-2.0
+
+package shard
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"sort"
+	"strconv"
+)
+
+// DefaultVirtualNodes is the number of points each member takes on the ring.
+const DefaultVirtualNodes = 64
+
+// Ring is a consistent hash ring, keys are assigned to the first member point
+// clockwise from the key hash. It is immutable once built.
+type Ring struct {
+	points []uint32
+	owners map[uint32]string
+}
+
+// NewRing builds a ring of members, each member takes vnodes points.
+func NewRing(members []string, vnodes int) *Ring {
+	if vnodes <= 0 {
+		vnodes = DefaultVirtualNodes
+	}
+	r := &Ring{
+		owners: make(map[uint32]string, len(members)*vnodes),
+	}
+	for _, m := range members {
+		for i := 0; i < vnodes; i++ {
+			h := hashKey(m + "#" + strconv.Itoa(i))
+			// on collision keep the smaller name, so every replica agrees
+			if old, ok := r.owners[h]; ok && old < m {
+				continue
+			}
+			if _, ok := r.owners[h]; !ok {
+				r.points = append(r.points, h)
+			}
+			r.owners[h] = m
+		}
+	}
+	sort.Slice(r.points, func(i, j int) bool { return r.points[i] < r.points[j] })
+	return r
+}
+
+// Owner returns the member owning key, empty if the ring has no member.
+func (r *Ring) Owner(key string) string {
+	if r == nil || len(r.points) == 0 {
+		return ""
+	}
+	h := hashKey(key)
+	i := sort.Search(len(r.points), func(i int) bool { return r.points[i] >= h })
+	if i == len(r.points) {
+		i = 0
+	}
+	return r.owners[r.points[i]]
+}
+
+func hashKey(s string) uint32 {
+	sum := sha256.Sum256([]byte(s))
+	return binary.BigEndian.Uint32(sum[:4])
+}
@@ -0,0 +1,43 @@
+// Copyright 2023 Authors of kmerge
+// SPDX-License-Identifier: Apache-2.0
+
+package shard
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRingOwner(t *testing.T) {
+	assert.Equal(t, "", NewRing(nil, 0).Owner("ns/name"))
+
+	r := NewRing([]string{"a", "b", "c"}, 0)
+	count := map[string]int{}
+	for i := 0; i < 3000; i++ {
+		key := fmt.Sprintf("ns-%d/name", i)
+		owner := r.Owner(key)
+		// same members always give the same owner
+		assert.Equal(t, owner, NewRing([]string{"c", "b", "a"}, 0).Owner(key))
+		count[owner]++
+	}
+	assert.Len(t, count, 3)
+	for _, v := range count {
+		assert.Greater(t, v, 500)
+	}
+}
+
+func TestRingRebalance(t *testing.T) {
+	before := NewRing([]string{"a", "b", "c"}, 0)
+	after := NewRing([]string{"a", "b"}, 0)
+	for i := 0; i < 1000; i++ {
+		key := fmt.Sprintf("ns-%d/name", i)
+		// only keys of the removed member move
+		if owner := before.Owner(key); owner != "c" {
+			assert.Equal(t, owner, after.Owner(key))
+		} else {
+			assert.NotEqual(t, "c", after.Owner(key))
+		}
+	}
+}
@@ -4,17 +4,53 @@ import (
 	"time"
 
 	"github.com/cenkalti/backoff/v4"
+	"k8s.io/utils/clock"
 )
 
 func Backoff(rfn func() error) error {
-	newbo := backoff.WithMaxRetries(&backoff.ConstantBackOff{Interval: time.Microsecond * 10}, 3)
-	return backoff.Retry(backoff.Operation(rfn), newbo)
+	return BackoffWithClock(clock.RealClock{}, rfn)
 }
 
 func TimeBackoff(rfn func() error) error {
+	return TimeBackoffWithClock(clock.RealClock{}, rfn)
+}
+
+// BackoffWithClock is Backoff waiting on c
+func BackoffWithClock(c clock.Clock, rfn func() error) error {
+	newbo := backoff.WithMaxRetries(&backoff.ConstantBackOff{Interval: time.Microsecond * 10}, 3)
+	return backoff.RetryNotifyWithTimer(backoff.Operation(rfn), newbo, nil, &clockTimer{clock: c})
+}
+
+// TimeBackoffWithClock is TimeBackoff waiting on c
+func TimeBackoffWithClock(c clock.Clock, rfn func() error) error {
 	expbf := backoff.NewExponentialBackOff()
 	expbf.InitialInterval = time.Second * 1
 	expbf.MaxElapsedTime = time.Second * 30
+	expbf.Clock = c
+
+	return backoff.RetryNotifyWithTimer(backoff.Operation(rfn), expbf, nil, &clockTimer{clock: c})
+}
+
+// clockTimer implements backoff.Timer on a clock
+type clockTimer struct {
+	clock clock.Clock
+	timer clock.Timer
+}
+
+func (t *clockTimer) C() <-chan time.Time {
+	return t.timer.C()
+}
+
+func (t *clockTimer) Start(d time.Duration) {
+	if t.timer == nil {
+		t.timer = t.clock.NewTimer(d)
+		return
+	}
+	t.timer.Reset(d)
+}
 
-	return backoff.Retry(backoff.Operation(rfn), expbf)
+func (t *clockTimer) Stop() {
+	if t.timer != nil {
+		t.timer.Stop()
+	}
 }
@@ -0,0 +1,56 @@
+package util
+
+import (
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	testingclock "k8s.io/utils/clock/testing"
+)
+
+func TestTimeBackoffWithClock(t *testing.T) {
+	var (
+		calls atomic.Int32
+		fc    = testingclock.NewFakeClock(time.Now())
+		done  = make(chan error)
+	)
+	go func() {
+		done <- TimeBackoffWithClock(fc, func() error {
+			if calls.Add(1) < 3 {
+				return errors.New("failed")
+			}
+			return nil
+		})
+	}()
+
+	// retried only when the clock passes the backoff
+	for i := int32(1); i < 3; i++ {
+		assert.Eventually(t, fc.HasWaiters, time.Second, time.Millisecond)
+		assert.Equal(t, i, calls.Load())
+		fc.Step(5 * time.Second)
+	}
+	assert.NoError(t, <-done)
+	assert.Equal(t, int32(3), calls.Load())
+}
+
+func TestTimeBackoffGiveUp(t *testing.T) {
+	var (
+		fc   = testingclock.NewFakeClock(time.Now())
+		done = make(chan error)
+	)
+	go func() {
+		done <- TimeBackoffWithClock(fc, func() error { return errors.New("failed") })
+	}()
+
+	// MaxElapsedTime passes on the clock
+	assert.Eventually(t, fc.HasWaiters, time.Second, time.Millisecond)
+	fc.Step(time.Minute)
+	select {
+	case err := <-done:
+		assert.Error(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("backoff did not give up")
+	}
+}
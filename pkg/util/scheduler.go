@@ -0,0 +1,331 @@
+package util
+
+import (
+	"container/heap"
+	"fmt"
+	"sync"
+	"time"
+
+	"k8s.io/klog/v2"
+	"k8s.io/utils/clock"
+)
+
+// SchedulerParameters are the user specified parameters of a Scheduler
+type SchedulerParameters struct {
+	// MinInterval is the minimum required interval between invocations of
+	// Func for the same key
+	MinInterval time.Duration
+
+	// Workers is the number of goroutines running Func
+	Workers int
+
+	// Func is called with the scheduled key, calls for the same key are
+	// serialized
+	Func func(key string)
+
+	// Clock is the time source, nil means the real clock
+	Clock clock.Clock
+
+	// Name is the name of the scheduler
+	Name string
+}
+
+// Window is the debounce of a key. A key is run once it was not scheduled
+// for Debounce, but no later than MaxWait after the first schedule. Zero
+// Debounce runs on the first schedule.
+type Window struct {
+	Debounce time.Duration
+	MaxWait  time.Duration
+}
+
+// due returns the time to run of a key first scheduled at first and last
+// scheduled at last.
+func (w Window) due(first, last time.Time) time.Time {
+	if w.Debounce <= 0 {
+		return last
+	}
+	due := last.Add(w.Debounce)
+	if w.MaxWait > 0 && due.After(first.Add(w.MaxWait)) {
+		due = first.Add(w.MaxWait)
+	}
+	return due
+}
+
+// Scheduler runs Func for scheduled keys on a bounded worker pool. It is the
+// Trigger of many keys: schedules of a key are folded until it runs, and runs
+// of a key respect MinInterval. Idle keys cost no goroutine.
+type Scheduler struct {
+	params SchedulerParameters
+
+	mu sync.Mutex
+
+	// keys is the state of the known keys
+	keys map[string]*schedItem
+
+	// pending holds the keys waiting to run, ordered by due time
+	pending schedHeap
+
+	wakeupChan chan struct{}
+	closeChan  chan struct{}
+	closeOnce  sync.Once
+
+	workChan chan *schedItem
+}
+
+type schedItem struct {
+	key string
+
+	// due is the time to run, valid while index >= 0
+	due time.Time
+
+	// index in the pending heap, -1 if not pending
+	index int
+
+	window Window
+
+	// first is the time of the first schedule folded into the next run
+	first time.Time
+
+	lastRun  time.Time
+	running  bool
+	numFolds int
+
+	// removed while running, it is forgotten when done
+	removed bool
+}
+
+// NewScheduler returns a started scheduler based on the provided parameters
+func NewScheduler(p SchedulerParameters) (*Scheduler, error) {
+	if p.Func == nil {
+		return nil, fmt.Errorf("scheduler function is nil")
+	}
+	if p.Workers <= 0 {
+		p.Workers = 1
+	}
+	if p.Clock == nil {
+		p.Clock = clock.RealClock{}
+	}
+
+	s := &Scheduler{
+		params:     p,
+		keys:       map[string]*schedItem{},
+		wakeupChan: make(chan struct{}, 1),
+		closeChan:  make(chan struct{}),
+		workChan:   make(chan *schedItem),
+	}
+	for i := 0; i < p.Workers; i++ {
+		go s.worker()
+	}
+	go s.loop()
+	return s, nil
+}
+
+// Schedule requests a run of Func for key within w. It is non-blocking, and
+// folds into the pending run of key if there is one, which is delayed by the
+// debounce of w.
+func (s *Scheduler) Schedule(key string, w Window) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.params.Clock.Now()
+	it, ok := s.keys[key]
+	if !ok {
+		it = &schedItem{key: key, index: -1}
+		s.keys[key] = it
+	}
+	it.removed = false
+	it.window = w
+	if it.numFolds == 0 {
+		it.first = now
+	}
+	it.numFolds++
+	switch {
+	case it.running:
+		// a running key is pushed again when it is done
+	case it.index >= 0:
+		it.due = s.dueOf(it, now)
+		heap.Fix(&s.pending, it.index)
+		s.wakeup(it)
+	default:
+		s.push(it, now)
+	}
+}
+
+// Remove forgets key, a pending run is dropped. A running Func is not
+// interrupted, and a new schedule of key still waits for it.
+func (s *Scheduler) Remove(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	it, ok := s.keys[key]
+	if !ok {
+		return
+	}
+	if it.index >= 0 {
+		heap.Remove(&s.pending, it.index)
+	}
+	if it.running {
+		// keep it to serialize with a new schedule of key
+		it.removed = true
+		it.numFolds = 0
+		return
+	}
+	delete(s.keys, key)
+}
+
+// Pending returns the number of keys waiting to run
+func (s *Scheduler) Pending() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.pending.Len()
+}
+
+// Shutdown stops running pending keys, running Func are not waited.
+func (s *Scheduler) Shutdown() {
+	s.closeOnce.Do(func() {
+		close(s.closeChan)
+	})
+}
+
+// dueOf returns the time to run of it last scheduled at now, the caller holds
+// the lock.
+func (s *Scheduler) dueOf(it *schedItem, now time.Time) time.Time {
+	due := it.window.due(it.first, now)
+	if !it.lastRun.IsZero() {
+		if next := it.lastRun.Add(s.params.MinInterval); next.After(due) {
+			due = next
+		}
+	}
+	return due
+}
+
+// push adds it to pending, the caller holds the lock.
+func (s *Scheduler) push(it *schedItem, now time.Time) {
+	it.due = s.dueOf(it, now)
+	heap.Push(&s.pending, it)
+	s.wakeup(it)
+}
+
+// wakeup wakes up the loop if it became the earliest key.
+func (s *Scheduler) wakeup(it *schedItem) {
+	if it.index == 0 {
+		select {
+		case s.wakeupChan <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// next pops a due key, or returns the wait until the earliest one.
+func (s *Scheduler) next(now time.Time) (*schedItem, time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.pending.Len() == 0 {
+		return nil, -1
+	}
+	it := s.pending[0]
+	if wait := it.due.Sub(now); wait > 0 {
+		return nil, wait
+	}
+	heap.Pop(&s.pending)
+	it.running = true
+	it.lastRun = now
+	klog.V(2).Infof("scheduler %s key %s had %d schedules before start", s.params.Name, it.key, it.numFolds)
+	it.numFolds = 0
+	return it, 0
+}
+
+func (s *Scheduler) loop() {
+	defer close(s.workChan)
+
+	var timer clock.Timer
+	defer func() {
+		if timer != nil {
+			timer.Stop()
+		}
+	}()
+	for {
+		it, wait := s.next(s.params.Clock.Now())
+		if it != nil {
+			select {
+			case s.workChan <- it:
+				continue
+			case <-s.closeChan:
+				return
+			}
+		}
+
+		var timeout <-chan time.Time
+		if wait > 0 {
+			if timer == nil {
+				timer = s.params.Clock.NewTimer(wait)
+			} else {
+				if !timer.Stop() {
+					select {
+					case <-timer.C():
+					default:
+					}
+				}
+				timer.Reset(wait)
+			}
+			timeout = timer.C()
+		}
+		select {
+		case <-timeout:
+		case <-s.wakeupChan:
+		case <-s.closeChan:
+			return
+		}
+	}
+}
+
+func (s *Scheduler) worker() {
+	for it := range s.workChan {
+		s.params.Func(it.key)
+		s.done(it)
+	}
+}
+
+// done pushes it again if it was scheduled while running.
+func (s *Scheduler) done(it *schedItem) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	it.running = false
+	switch {
+	case it.removed:
+		delete(s.keys, it.key)
+	case it.numFolds > 0:
+		s.push(it, s.params.Clock.Now())
+	}
+}
+
+// schedHeap is a min-heap of pending keys by due time
+type schedHeap []*schedItem
+
+func (h schedHeap) Len() int { return len(h) }
+
+func (h schedHeap) Less(i, j int) bool { return h[i].due.Before(h[j].due) }
+
+func (h schedHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *schedHeap) Push(x any) {
+	it := x.(*schedItem)
+	it.index = len(*h)
+	*h = append(*h, it)
+}
+
+func (h *schedHeap) Pop() any {
+	old := *h
+	n := len(old)
+	it := old[n-1]
+	old[n-1] = nil
+	it.index = -1
+	*h = old[:n-1]
+	return it
+}
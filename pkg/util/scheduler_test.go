@@ -0,0 +1,174 @@
+package util
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	testingclock "k8s.io/utils/clock/testing"
+)
+
+func TestSchedulerFold(t *testing.T) {
+	var (
+		mu   sync.Mutex
+		runs = map[string]int{}
+		gate = make(chan struct{})
+	)
+	s, err := NewScheduler(SchedulerParameters{
+		MinInterval: 50 * time.Millisecond,
+		Workers:     2,
+		Func: func(key string) {
+			<-gate
+			mu.Lock()
+			runs[key]++
+			mu.Unlock()
+		},
+	})
+	assert.NoError(t, err)
+	defer s.Shutdown()
+
+	// the first run starts now, the schedules while running fold into one
+	s.Schedule("a", Window{})
+	assert.Eventually(t, func() bool { return s.Pending() == 0 }, time.Second, time.Millisecond)
+	for i := 0; i < 100; i++ {
+		s.Schedule("a", Window{})
+	}
+	close(gate)
+
+	assert.Eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return runs["a"] == 2
+	}, time.Second, time.Millisecond)
+	time.Sleep(100 * time.Millisecond)
+	mu.Lock()
+	assert.Equal(t, 2, runs["a"])
+	mu.Unlock()
+}
+
+func newTestScheduler(t *testing.T, minInterval time.Duration) (*Scheduler, *testingclock.FakeClock, *atomic.Int32) {
+	var runs atomic.Int32
+	fc := testingclock.NewFakeClock(time.Now())
+	s, err := NewScheduler(SchedulerParameters{
+		MinInterval: minInterval,
+		Clock:       fc,
+		Func:        func(string) { runs.Add(1) },
+	})
+	assert.NoError(t, err)
+	t.Cleanup(s.Shutdown)
+	return s, fc, &runs
+}
+
+func TestSchedulerMinInterval(t *testing.T) {
+	s, fc, runs := newTestScheduler(t, time.Second)
+
+	s.Schedule("a", Window{})
+	waitRuns(t, runs, 1)
+
+	s.Schedule("a", Window{})
+	assert.Eventually(t, fc.HasWaiters, time.Second, time.Millisecond)
+	fc.Step(999 * time.Millisecond)
+	time.Sleep(10 * time.Millisecond)
+	assert.Equal(t, int32(1), runs.Load())
+
+	fc.Step(time.Millisecond)
+	waitRuns(t, runs, 2)
+}
+
+func TestSchedulerWorkers(t *testing.T) {
+	var (
+		running, peak, total atomic.Int32
+		perKey               sync.Map
+	)
+	s, err := NewScheduler(SchedulerParameters{
+		Workers: 3,
+		Func: func(key string) {
+			v, _ := perKey.LoadOrStore(key, new(atomic.Int32))
+			if v.(*atomic.Int32).Add(1) != 1 {
+				t.Errorf("key %s runs concurrently", key)
+			}
+			n := running.Add(1)
+			for {
+				p := peak.Load()
+				if n <= p || peak.CompareAndSwap(p, n) {
+					break
+				}
+			}
+			time.Sleep(time.Millisecond)
+			running.Add(-1)
+			v.(*atomic.Int32).Add(-1)
+			total.Add(1)
+		},
+	})
+	assert.NoError(t, err)
+	defer s.Shutdown()
+
+	for i := 0; i < 1000; i++ {
+		s.Schedule(fmt.Sprintf("key%d", i%50), Window{})
+	}
+	assert.Eventually(t, func() bool {
+		return s.Pending() == 0 && running.Load() == 0
+	}, 5*time.Second, time.Millisecond)
+	assert.LessOrEqual(t, peak.Load(), int32(3))
+	assert.GreaterOrEqual(t, total.Load(), int32(50))
+}
+
+func TestSchedulerRemove(t *testing.T) {
+	var runs atomic.Int32
+	s, err := NewScheduler(SchedulerParameters{
+		MinInterval: time.Hour,
+		Func:        func(string) { runs.Add(1) },
+	})
+	assert.NoError(t, err)
+	defer s.Shutdown()
+
+	s.Schedule("a", Window{})
+	assert.Eventually(t, func() bool { return runs.Load() == 1 }, time.Second, time.Millisecond)
+
+	// waits for MinInterval, until removed
+	s.Schedule("a", Window{})
+	assert.Equal(t, 1, s.Pending())
+	s.Remove("a")
+	assert.Equal(t, 0, s.Pending())
+
+	// a removed key starts over
+	s.Schedule("a", Window{})
+	assert.Eventually(t, func() bool { return runs.Load() == 2 }, time.Second, time.Millisecond)
+}
+
+func TestSchedulerDebounce(t *testing.T) {
+	s, fc, runs := newTestScheduler(t, 0)
+
+	// 200 schedules in a burst run once, after the quiet period
+	w := Window{Debounce: time.Second, MaxWait: time.Minute}
+	for i := 0; i < 200; i++ {
+		s.Schedule("a", w)
+	}
+	assert.Eventually(t, fc.HasWaiters, time.Second, time.Millisecond)
+	fc.Step(999 * time.Millisecond)
+	time.Sleep(10 * time.Millisecond)
+	assert.Equal(t, int32(0), runs.Load())
+	fc.Step(time.Millisecond)
+	waitRuns(t, runs, 1)
+	time.Sleep(10 * time.Millisecond)
+	assert.Equal(t, int32(1), runs.Load())
+}
+
+func TestSchedulerMaxWait(t *testing.T) {
+	s, fc, runs := newTestScheduler(t, 0)
+
+	// schedules keep coming, the run waits no longer than MaxWait
+	w := Window{Debounce: time.Second, MaxWait: 2 * time.Second}
+	for i := 0; i < 3; i++ {
+		s.Schedule("a", w)
+		assert.Eventually(t, fc.HasWaiters, time.Second, time.Millisecond)
+		fc.Step(500 * time.Millisecond)
+	}
+	s.Schedule("a", w)
+	assert.Equal(t, int32(0), runs.Load())
+	fc.Step(500 * time.Millisecond)
+	waitRuns(t, runs, 1)
+}
@@ -7,6 +7,7 @@ import (
 	sync "github.com/yylt/kmerge/pkg/lock"
 
 	"k8s.io/klog/v2"
+	"k8s.io/utils/clock"
 )
 
 // Parameters are the user specified parameters
@@ -22,6 +23,9 @@ type Parameters struct {
 	// ShutdownFunc is called when the trigger is shut down
 	ShutdownFunc func()
 
+	// Clock is the time source, nil means the real clock
+	Clock clock.Clock
+
 	// Name is the unique name of the trigger. It must be provided in a
 	// format compatible to be used as prometheus name string.
 	Name string
@@ -57,6 +61,9 @@ func NewTrigger(p Parameters) (*Trigger, error) {
 	if p.TriggerFunc == nil {
 		return nil, fmt.Errorf("trigger function is nil")
 	}
+	if p.Clock == nil {
+		p.Clock = clock.RealClock{}
+	}
 
 	t := &Trigger{
 		params:     p,
@@ -66,7 +73,7 @@ func NewTrigger(p Parameters) (*Trigger, error) {
 
 	// Guarantee that initial trigger has no delay
 	if p.MinInterval > time.Duration(0) {
-		t.lastTrigger = time.Now().Add(-1 * p.MinInterval)
+		t.lastTrigger = p.Clock.Now().Add(-1 * p.MinInterval)
 	}
 
 	go t.waiter()
@@ -81,7 +88,7 @@ func (t *Trigger) needsDelay() (bool, time.Duration) {
 		return false, 0
 	}
 
-	sleepTime := time.Since(t.lastTrigger.Add(t.params.MinInterval))
+	sleepTime := t.params.Clock.Since(t.lastTrigger.Add(t.params.MinInterval))
 	return sleepTime < 0, sleepTime * -1
 }
 
@@ -106,6 +113,24 @@ func (t *Trigger) Shutdown() {
 	close(t.closeChan)
 }
 
+// sleep waits for d, it returns false if the trigger is shut down meanwhile
+func (t *Trigger) sleep(d time.Duration) bool {
+	select {
+	case <-t.params.Clock.After(d):
+		return true
+	case <-t.closeChan:
+		return false
+	}
+}
+
+// Folds returns the number of Trigger() calls folded into the next
+// invocation of TriggerFunc
+func (t *Trigger) Folds() int {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+	return t.numFolds
+}
+
 func (t *Trigger) waiter() {
 	for {
 		// keep critical section as small as possible
@@ -116,12 +141,13 @@ func (t *Trigger) waiter() {
 
 		// run the trigger function
 		if triggerEnabled {
-			if delayNeeded, delay := t.needsDelay(); delayNeeded {
-				time.Sleep(delay)
+			if delayNeeded, delay := t.needsDelay(); delayNeeded && !t.sleep(delay) {
+				t.shutdown()
+				return
 			}
 
 			t.mutex.Lock()
-			t.lastTrigger = time.Now()
+			t.lastTrigger = t.params.Clock.Now()
 			klog.Infof("trigger %s had trigger number %d before start", t.params.Name, t.numFolds)
 			t.numFolds = 0
 			t.mutex.Unlock()
@@ -132,11 +158,15 @@ func (t *Trigger) waiter() {
 		select {
 		case <-t.wakeupChan:
 		case <-t.closeChan:
-			shutdownFunc := t.params.ShutdownFunc
-			if shutdownFunc != nil {
-				shutdownFunc()
-			}
+			t.shutdown()
 			return
 		}
 	}
 }
+
+func (t *Trigger) shutdown() {
+	shutdownFunc := t.params.ShutdownFunc
+	if shutdownFunc != nil {
+		shutdownFunc()
+	}
+}
@@ -0,0 +1,71 @@
+package util
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	testingclock "k8s.io/utils/clock/testing"
+)
+
+func newTestTrigger(t *testing.T, p Parameters) (*Trigger, *testingclock.FakeClock, *atomic.Int32) {
+	var runs atomic.Int32
+	fc := testingclock.NewFakeClock(time.Now())
+	p.Clock = fc
+	p.TriggerFunc = func() { runs.Add(1) }
+	tr, err := NewTrigger(p)
+	assert.NoError(t, err)
+	t.Cleanup(tr.Shutdown)
+	return tr, fc, &runs
+}
+
+// waitRuns waits for the trigger to settle on n runs
+func waitRuns(t *testing.T, runs *atomic.Int32, n int32) {
+	assert.Eventually(t, func() bool { return runs.Load() == n }, time.Second, time.Millisecond)
+}
+
+func TestTriggerMinInterval(t *testing.T) {
+	tr, fc, runs := newTestTrigger(t, Parameters{MinInterval: time.Second})
+
+	// the first trigger has no delay
+	tr.Trigger()
+	waitRuns(t, runs, 1)
+
+	tr.Trigger()
+	assert.Eventually(t, fc.HasWaiters, time.Second, time.Millisecond)
+	tr.Trigger()
+	assert.Equal(t, 2, tr.Folds())
+
+	fc.Step(999 * time.Millisecond)
+	time.Sleep(10 * time.Millisecond)
+	assert.Equal(t, int32(1), runs.Load())
+
+	fc.Step(time.Millisecond)
+	waitRuns(t, runs, 2)
+	assert.Equal(t, 0, tr.Folds())
+}
+
+func TestTriggerShutdownWhileDelayed(t *testing.T) {
+	var runs, shutdowns atomic.Int32
+	fc := testingclock.NewFakeClock(time.Now())
+	tr, err := NewTrigger(Parameters{
+		MinInterval:  time.Second,
+		Clock:        fc,
+		TriggerFunc:  func() { runs.Add(1) },
+		ShutdownFunc: func() { shutdowns.Add(1) },
+	})
+	assert.NoError(t, err)
+
+	tr.Trigger()
+	waitRuns(t, &runs, 1)
+	tr.Trigger()
+	assert.Eventually(t, fc.HasWaiters, time.Second, time.Millisecond)
+
+	// the delayed call is dropped
+	tr.Shutdown()
+	assert.Eventually(t, func() bool { return shutdowns.Load() == 1 }, time.Second, time.Millisecond)
+	fc.Step(time.Second)
+	time.Sleep(10 * time.Millisecond)
+	assert.Equal(t, int32(1), runs.Load())
+}